@@ -9,7 +9,7 @@ import (
 	"gorm.io/gorm"
 )
 
-var Tables = []any{&models.User{}, &models.Document{}, &models.DocumentCollaborator{}}
+var Tables = []any{&models.User{}, &models.Document{}, &models.DocumentCollaborator{}, &models.DocumentOperation{}, &models.DocumentCheckpoint{}, &models.DocumentSnapshot{}, &models.DocumentBlame{}, &models.DocumentSuggestion{}}
 
 func InitDB() *gorm.DB {
 
@@ -25,6 +25,21 @@ func InitDB() *gorm.DB {
 		log.Fatalf("Failed to migrate tables: %v", err)
 	}
 
+	if err := migrateAccessLevels(db); err != nil {
+		log.Fatalf("Failed to migrate collaborator access levels: %v", err)
+	}
+
 	log.Println("Connected to Database 📀")
 	return db
 }
+
+// migrateAccessLevels turns the read and write access stored before roles into viewer and editor
+func migrateAccessLevels(db *gorm.DB) error {
+	for legacy, role := range models.LegacyAccessLevels {
+		err := db.Model(&models.DocumentCollaborator{}).Where("access = ?", legacy).Update("access", role).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
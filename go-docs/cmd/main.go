@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"go-docs/cmd/server"
 	"go-docs/cmd/services"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/joho/godotenv"
 )
@@ -20,18 +25,21 @@ func main() {
 	userSearchTrie := services.PushUsersToTrie(db)
 	log.Printf("Loaded users into search trie users")
 
-	r := server.StartRestServer(db, redis, userSearchTrie)
+	rest := server.StartRestServer(context.Background(), db, redis, userSearchTrie)
 
-	sqlDB, err := db.DB()
-	if err != nil {
-		log.Fatalf("Failed to get database instance: %v", err)
-	}
-	defer sqlDB.Close()
-	defer redis.Close()
+	httpServer := &http.Server{Addr: ":3001", Handler: rest.Router}
 
-	log.Println("Starting REST server on port 3001 🚀")
-	if err := http.ListenAndServe(":3001", r); err != nil {
-		log.Fatalf("Failed to start REST server: %v", err)
-	}
+	go func() {
+		log.Println("Starting REST server on port 3001 🚀")
+		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Failed to start REST server: %v", err)
+		}
+	}()
 
+	signals, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	<-signals.Done()
+
+	log.Println("Shutting down 🛑")
+	shutdown(httpServer, rest, db, redis)
 }
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"go-docs/cmd/rope"
 	"sync"
 	"time"
 
@@ -17,15 +18,17 @@ type User struct {
 }
 
 type Document struct {
-	ID           uuid.UUID              `gorm:"type:uuid;default:uuid_generate_v4();primaryKey" json:"id"`
-	Title        string                 `gorm:"not null" json:"title"`
-	Content      string                 `gorm:"not null" json:"content"`
-	AuthorID     uuid.UUID              `gorm:"not null" json:"author_id"`
-	Author       User                   `gorm:"foreignKey:AuthorID" json:"author"`
-	Version      int                    `gorm:"not null default 0" json:"version"`
-	Collaborator []DocumentCollaborator `gorm:"foreignKey:DocumentID" json:"collaborators"`
-	CreatedAt    time.Time              `gorm:"autoCreateTime" json:"created_at"`
-	UpdatedAt    time.Time              `gorm:"autoUpdateTime" json:"updated_at"`
+	ID            uuid.UUID              `gorm:"type:uuid;default:uuid_generate_v4();primaryKey" json:"id"`
+	Title         string                 `gorm:"not null" json:"title"`
+	Content       string                 `gorm:"not null" json:"content"`
+	AuthorID      uuid.UUID              `gorm:"not null" json:"author_id"`
+	Author        User                   `gorm:"foreignKey:AuthorID" json:"author"`
+	Version       int                    `gorm:"not null default 0" json:"version"`
+	Collaborator  []DocumentCollaborator `gorm:"foreignKey:DocumentID" json:"collaborators"`
+	ParentID      *uuid.UUID             `gorm:"type:uuid;index" json:"parent_id,omitempty"` // The document this one was forked from
+	ParentVersion *int                   `json:"parent_version,omitempty"`                   // The version of the parent it was forked at
+	CreatedAt     time.Time              `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt     time.Time              `gorm:"autoUpdateTime" json:"updated_at"`
 }
 
 type DocumentCollaborator struct {
@@ -39,13 +42,6 @@ type DocumentCollaborator struct {
 	UpdatedAt  time.Time   `gorm:"autoUpdateTime" json:"updated_at"`
 }
 
-const (
-	AccessLevelRead  AccessLevel = "read"
-	AccessLevelWrite AccessLevel = "write"
-)
-
-type AccessLevel string
-
 type OperationType string
 
 const (
@@ -54,25 +50,143 @@ const (
 	OperationTypeDelete  OperationType = "delete"
 )
 
-// Not storing in db, will add later if needed
+// Every applied operation is appended to document_operations, the version it
+// produced is unique per document. One submitted operation can be split by the
+// transform into several rows sharing the same ID.
 type DocumentOperation struct {
-	ID            uuid.UUID     `json:"id"`
-	DocumentID    uuid.UUID     `json:"document_id"`
-	UserID        uuid.UUID     `json:"user_id"`
-	OperationType OperationType `json:"operation_type"`
-	Content       string        `json:"content"`
-	Pos           int           `json:"pos"`
-	DeleteLen     int           `json:"delete_len"`
-	BaseVersion   int           `json:"base_version"`
-	Timestamp     time.Time     `json:"timestamp"`
+	ID            uuid.UUID     `gorm:"type:uuid;not null;index" json:"id"`
+	DocumentID    uuid.UUID     `gorm:"type:uuid;primaryKey" json:"document_id"`
+	UserID        uuid.UUID     `gorm:"type:uuid;not null" json:"user_id"`
+	OperationType OperationType `gorm:"not null" json:"operation_type"`
+	Content       string        `gorm:"not null;default:''" json:"content"`
+	Pos           int           `gorm:"not null" json:"pos"`
+	DeleteLen     int           `gorm:"not null;default:0" json:"delete_len"`
+	Deleted       string        `gorm:"not null;default:''" json:"deleted,omitempty"` // Text removed, to revert the operation
+	BaseVersion   int           `gorm:"not null" json:"base_version"`
+	Version       int           `gorm:"primaryKey;autoIncrement:false" json:"version"`
+	Timestamp     time.Time     `gorm:"not null" json:"timestamp"`
+}
+
+// DocumentCheckpoint is the full content at a version, older versions are
+// rebuilt from the closest checkpoint and the operation log.
+type DocumentCheckpoint struct {
+	DocumentID uuid.UUID `gorm:"type:uuid;primaryKey" json:"document_id"`
+	Version    int       `gorm:"primaryKey;autoIncrement:false" json:"version"`
+	Content    string    `gorm:"not null" json:"content"`
+	CreatedAt  time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+// DocumentSnapshot is a version a user pinned under a name. It keeps a copy of
+// the content, whatever happens to the operation log and checkpoints later on.
+type DocumentSnapshot struct {
+	ID          uuid.UUID `gorm:"type:uuid;default:uuid_generate_v4();primaryKey" json:"id"`
+	DocumentID  uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_document_snapshot_name" json:"document_id"`
+	Name        string    `gorm:"not null;uniqueIndex:idx_document_snapshot_name" json:"name"`
+	Description string    `gorm:"not null;default:''" json:"description"`
+	Version     int       `gorm:"not null" json:"version"`
+	Content     string    `gorm:"not null" json:"content,omitempty"`
+	CreatedByID uuid.UUID `gorm:"type:uuid;not null" json:"created_by_id"`
+	CreatedBy   User      `gorm:"foreignKey:CreatedByID" json:"created_by"`
+	CreatedAt   time.Time `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt   time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+// BlameSpan attributes the next Length runes of a document to the user who
+// wrote them, Version being the last operation of that user touching them.
+type BlameSpan struct {
+	Length  int       `json:"length"`
+	UserID  uuid.UUID `json:"user_id"`
+	Version int       `json:"version"`
+}
+
+// DocumentBlame is the authorship of a whole document at Version, saved on
+// flush so it does not have to be replayed from the first checkpoint.
+type DocumentBlame struct {
+	DocumentID uuid.UUID   `gorm:"type:uuid;primaryKey" json:"document_id"`
+	Version    int         `gorm:"not null" json:"version"`
+	Spans      []BlameSpan `gorm:"type:jsonb;serializer:json;not null" json:"spans"`
+	UpdatedAt  time.Time   `gorm:"autoUpdateTime" json:"updated_at"`
 }
 
+type SuggestionStatus string
+
+const (
+	SuggestionStatusPending  SuggestionStatus = "pending"
+	SuggestionStatusAccepted SuggestionStatus = "accepted"
+	SuggestionStatusRejected SuggestionStatus = "rejected"
+)
+
+// DocumentSuggestion is an edit proposed instead of applied. It is anchored on
+// [Pos, Pos+DeleteLen) of the document at Version, in runes, and the anchor is
+// moved along with every operation until the suggestion is resolved.
+type DocumentSuggestion struct {
+	ID            uuid.UUID        `gorm:"type:uuid;default:uuid_generate_v4();primaryKey" json:"id"`
+	DocumentID    uuid.UUID        `gorm:"type:uuid;not null;index" json:"document_id"`
+	UserID        uuid.UUID        `gorm:"type:uuid;not null" json:"user_id"`
+	User          User             `gorm:"foreignKey:UserID" json:"user"`
+	OperationType OperationType    `gorm:"not null" json:"operation_type"`
+	Pos           int              `gorm:"not null" json:"pos"`
+	DeleteLen     int              `gorm:"not null;default:0" json:"delete_len"`
+	Content       string           `gorm:"not null;default:''" json:"content"`
+	Deleted       string           `gorm:"not null;default:''" json:"deleted"` // Text it replaces, as it was when suggested
+	Version       int              `gorm:"not null" json:"version"`
+	Status        SuggestionStatus `gorm:"not null;default:'pending';index" json:"status"`
+	ResolvedByID  *uuid.UUID       `gorm:"type:uuid" json:"resolved_by_id,omitempty"`
+	ResolvedAt    *time.Time       `json:"resolved_at,omitempty"`
+	CreatedAt     time.Time        `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt     time.Time        `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+// OperationCommit is the outcome of one submitted operation. Operations is what
+// it became after the transform, possibly nothing, and Version the document
+// version once all of them are applied. Contents holds the document before
+// each operation and after the last one, it is only known on the instance
+// that applied them.
+type OperationCommit struct {
+	DocumentID  uuid.UUID           `json:"document_id"`
+	OperationID uuid.UUID           `json:"operation_id"`
+	Operations  []DocumentOperation `json:"operations"`
+	Version     int                 `json:"version"`
+	Duplicate   bool                `json:"duplicate"`
+	Contents    []*rope.Rope        `json:"-"`
+}
+
+// OperationCache is an active document. Its text lives in Content and is only
+// turned back into a string when it is flushed or handed out, ActiveDocument
+// keeps everything else and an empty Content.
 type OperationCache struct {
 	Operations     []DocumentOperation
 	LastUsed       time.Time
 	ActiveDocument *Document
+	Content        *rope.Rope
 	Dirty          bool
+	Evicted        bool // Dropped from the active documents, load it again
 	Mu             sync.Mutex
+	Seen           map[uuid.UUID]int // Recently committed operation IDs and their version
+	SeenOrder      []uuid.UUID
+	Checkpoint     int                  // Version of the newest DocumentCheckpoint
+	Fence          int64                // Lease token the cache was last caught up under, 0 when never
+	Blame          []BlameSpan          // Authorship of Content, nil until loaded. Replaced on every operation, never modified.
+	Suggestions    []DocumentSuggestion // Pending suggestions anchored at the cached version, nil until loaded
+}
+
+func NewOperationCache(document *Document) *OperationCache {
+	content := rope.New(document.Content)
+	document.Content = ""
+
+	return &OperationCache{
+		ActiveDocument: document,
+		Content:        content,
+		Operations:     []DocumentOperation{},
+		LastUsed:       time.Now(),
+	}
+}
+
+// Snapshot copies the active document with its content materialized, O(n)
+func (c *OperationCache) Snapshot() Document {
+	document := *c.ActiveDocument
+	document.Content = c.Content.String()
+	return document
 }
 
 type UserRecord struct {
@@ -0,0 +1,97 @@
+package models
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/google/uuid"
+)
+
+// AccessLevel is the role of a user on a document. The author of a document
+// is always its owner, everybody else gets a role as a collaborator.
+type AccessLevel string
+
+const (
+	AccessLevelOwner     AccessLevel = "owner"
+	AccessLevelEditor    AccessLevel = "editor"
+	AccessLevelCommenter AccessLevel = "commenter"
+	AccessLevelViewer    AccessLevel = "viewer"
+)
+
+// Access levels from before roles, still accepted and stored as the matching role
+var LegacyAccessLevels = map[string]AccessLevel{
+	"read":    AccessLevelViewer,
+	"suggest": AccessLevelCommenter,
+	"write":   AccessLevelEditor,
+}
+
+// AccessChange tells the live sessions of a user their new role on a document,
+// an empty Access means it was revoked
+type AccessChange struct {
+	DocumentID uuid.UUID   `json:"document_id"`
+	UserID     uuid.UUID   `json:"user_id"`
+	Access     AccessLevel `json:"access"`
+}
+
+type Capability string
+
+const (
+	CapabilityView                Capability = "view"                 // Open the document, its history and presence
+	CapabilityExport              Capability = "export"               // Copy the content out, as a fork
+	CapabilityComment             Capability = "comment"              // Suggest changes
+	CapabilityEdit                Capability = "edit"                 // Change the content, restore versions, name versions
+	CapabilityShare               Capability = "share"                // Add collaborators
+	CapabilityManageCollaborators Capability = "manage_collaborators" // Change or revoke access, resolve suggestions
+	CapabilityDelete              Capability = "delete"
+)
+
+/*
+What each role can do, every role can do everything the ones below it can:
+
+	view export comment edit share manage delete
+
+owner         x     x      x      x    x     x      x
+editor        x     x      x      x    x
+commenter     x     x      x
+viewer        x
+*/
+var roleCapabilities = map[AccessLevel][]Capability{
+	AccessLevelOwner: {
+		CapabilityView, CapabilityExport, CapabilityComment, CapabilityEdit,
+		CapabilityShare, CapabilityManageCollaborators, CapabilityDelete,
+	},
+	AccessLevelEditor:    {CapabilityView, CapabilityExport, CapabilityComment, CapabilityEdit, CapabilityShare},
+	AccessLevelCommenter: {CapabilityView, CapabilityExport, CapabilityComment},
+	AccessLevelViewer:    {CapabilityView},
+}
+
+// Can tells whether the role allows capability, an unknown role allows nothing
+func (a AccessLevel) Can(capability Capability) bool {
+	return slices.Contains(roleCapabilities[a], capability)
+}
+
+// CanGrant tells whether the role may give role to someone else, it has to be
+// allowed to share and to do everything role can. Owner is never given, the
+// author stays the only owner of a document.
+func (a AccessLevel) CanGrant(role AccessLevel) bool {
+	if role == AccessLevelOwner || !a.Can(CapabilityShare) {
+		return false
+	}
+	for _, capability := range roleCapabilities[role] {
+		if !a.Can(capability) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseAccessLevel accepts a role, or one of the access levels from before roles
+func ParseAccessLevel(value string) (AccessLevel, error) {
+	if _, ok := roleCapabilities[AccessLevel(value)]; ok {
+		return AccessLevel(value), nil
+	}
+	if role, ok := LegacyAccessLevels[value]; ok {
+		return role, nil
+	}
+	return "", fmt.Errorf("unknown access %q, expected owner, editor, commenter or viewer", value)
+}
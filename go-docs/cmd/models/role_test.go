@@ -0,0 +1,35 @@
+package models
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCanGrant(t *testing.T) {
+	roles := []AccessLevel{AccessLevelOwner, AccessLevelEditor, AccessLevelCommenter, AccessLevelViewer}
+	// Who can give what, owner is never given
+	grantable := map[AccessLevel][]AccessLevel{
+		AccessLevelOwner:  {AccessLevelEditor, AccessLevelCommenter, AccessLevelViewer},
+		AccessLevelEditor: {AccessLevelEditor, AccessLevelCommenter, AccessLevelViewer},
+	}
+
+	for _, granter := range roles {
+		for _, role := range roles {
+			want := slices.Contains(grantable[granter], role)
+			if got := granter.CanGrant(role); got != want {
+				t.Errorf("%s.CanGrant(%s) = %v, want %v", granter, role, got, want)
+			}
+		}
+	}
+}
+
+func TestParseAccessLevel(t *testing.T) {
+	for value, want := range map[string]AccessLevel{"owner": AccessLevelOwner, "editor": AccessLevelEditor, "write": AccessLevelEditor, "suggest": AccessLevelCommenter, "read": AccessLevelViewer} {
+		if got, err := ParseAccessLevel(value); err != nil || got != want {
+			t.Errorf("ParseAccessLevel(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+	if _, err := ParseAccessLevel("admin"); err == nil {
+		t.Errorf("ParseAccessLevel accepted an unknown role")
+	}
+}
@@ -0,0 +1,318 @@
+package rope
+
+import "strings"
+
+/*
+Rope holds the text of an active document as a height balanced tree of rune
+chunks, so an edit costs O(log n) instead of rebuilding the whole string.
+
+A Rope is never modified, Insert and Delete return a new one sharing every
+untouched chunk with the old one. Keeping the document as it was before an
+operation is free, and a Rope can be read without a lock once published.
+
+Every node counts its runes and UTF-16 code units, positions in either unit
+are found in O(log n).
+*/
+type Rope struct {
+	root *node
+}
+
+// Chunks are split above this many runes and merged below it when they meet
+const maxLeafLength = 512
+
+type node struct {
+	left, right *node
+	text        []rune // Only set on leaves, never modified once built
+	length      int    // Runes
+	utf16       int    // UTF-16 code units
+	height      int
+}
+
+func New(text string) *Rope {
+	return &Rope{root: build([]rune(text))}
+}
+
+// build makes a balanced tree out of runes, which it keeps
+func build(runes []rune) *node {
+	if len(runes) == 0 {
+		return nil
+	}
+	if len(runes) <= maxLeafLength {
+		return newLeaf(runes)
+	}
+
+	middle := len(runes) / 2
+	return newBranch(build(runes[:middle]), build(runes[middle:]))
+}
+
+func newLeaf(runes []rune) *node {
+	if len(runes) == 0 {
+		return nil
+	}
+
+	utf16 := len(runes)
+	for _, r := range runes {
+		if r >= 0x10000 {
+			utf16++
+		}
+	}
+	return &node{text: runes, length: len(runes), utf16: utf16}
+}
+
+func newBranch(left, right *node) *node {
+	return &node{
+		left:   left,
+		right:  right,
+		length: left.length + right.length,
+		utf16:  left.utf16 + right.utf16,
+		height: max(left.height, right.height) + 1,
+	}
+}
+
+func (n *node) isLeaf() bool {
+	return n.left == nil && n.right == nil
+}
+
+func height(n *node) int {
+	if n == nil {
+		return -1
+	}
+	return n.height
+}
+
+// Len is the length in runes
+func (r *Rope) Len() int {
+	if r == nil || r.root == nil {
+		return 0
+	}
+	return r.root.length
+}
+
+// UTF16Len is the length in UTF-16 code units, what a browser reports
+func (r *Rope) UTF16Len() int {
+	if r == nil || r.root == nil {
+		return 0
+	}
+	return r.root.utf16
+}
+
+// Insert returns the rope with text inserted before the rune at pos, pos must be in [0, Len()]
+func (r *Rope) Insert(pos int, text string) *Rope {
+	if text == "" {
+		return r
+	}
+
+	left, right := split(r.root, pos)
+	return &Rope{root: join(join(left, build([]rune(text))), right)}
+}
+
+// Delete returns the rope without the length runes starting at pos, the range must be inside the rope
+func (r *Rope) Delete(pos, length int) *Rope {
+	if length == 0 {
+		return r
+	}
+
+	left, rest := split(r.root, pos)
+	_, right := split(rest, length)
+	return &Rope{root: join(left, right)}
+}
+
+// Slice returns the runes in [start, end) as a string
+func (r *Rope) Slice(start, end int) string {
+	if r == nil || start >= end {
+		return ""
+	}
+
+	builder := strings.Builder{}
+	r.root.each(start, end, func(runes []rune) {
+		for _, char := range runes {
+			builder.WriteRune(char)
+		}
+	})
+	return builder.String()
+}
+
+// String materializes the whole text, O(n)
+func (r *Rope) String() string {
+	if r == nil || r.root == nil {
+		return ""
+	}
+
+	builder := strings.Builder{}
+	builder.Grow(r.root.length)
+	r.root.each(0, r.root.length, func(runes []rune) {
+		for _, char := range runes {
+			builder.WriteRune(char)
+		}
+	})
+	return builder.String()
+}
+
+// Runes materializes the whole text as runes, O(n)
+func (r *Rope) Runes() []rune {
+	runes := make([]rune, 0, r.Len())
+	if r != nil && r.root != nil {
+		r.root.each(0, r.root.length, func(chunk []rune) {
+			runes = append(runes, chunk...)
+		})
+	}
+	return runes
+}
+
+// RuneToUTF16 converts a rune offset into UTF-16 code units
+func (r *Rope) RuneToUTF16(pos int) int {
+	pos = min(max(pos, 0), r.Len())
+
+	offset := 0
+	n := r.root
+	for n != nil && !n.isLeaf() {
+		if pos < n.left.length {
+			n = n.left
+			continue
+		}
+		pos -= n.left.length
+		offset += n.left.utf16
+		n = n.right
+	}
+
+	if n != nil {
+		for _, char := range n.text[:pos] {
+			offset++
+			if char >= 0x10000 {
+				offset++
+			}
+		}
+	}
+	return offset
+}
+
+// UTF16ToRune converts an offset in UTF-16 code units into runes. It fails
+// past the end or in the middle of a surrogate pair.
+func (r *Rope) UTF16ToRune(offset int) (int, bool) {
+	if offset < 0 || offset > r.UTF16Len() {
+		return 0, false
+	}
+
+	pos := 0
+	n := r.root
+	for n != nil && !n.isLeaf() {
+		if offset < n.left.utf16 {
+			n = n.left
+			continue
+		}
+		offset -= n.left.utf16
+		pos += n.left.length
+		n = n.right
+	}
+
+	if n != nil {
+		for _, char := range n.text {
+			if offset <= 0 {
+				break
+			}
+			offset--
+			if char >= 0x10000 {
+				offset--
+			}
+			pos++
+		}
+	}
+	return pos, offset == 0
+}
+
+// each calls fn with the chunks covering [start, end) in order
+func (n *node) each(start, end int, fn func(runes []rune)) {
+	if n == nil || start >= end {
+		return
+	}
+
+	if n.isLeaf() {
+		fn(n.text[max(start, 0):min(end, n.length)])
+		return
+	}
+
+	if start < n.left.length {
+		n.left.each(start, end, fn)
+	}
+	if end > n.left.length {
+		n.right.each(start-n.left.length, end-n.left.length, fn)
+	}
+}
+
+// split cuts n into the runes before pos and the ones from pos on
+func split(n *node, pos int) (*node, *node) {
+	if n == nil {
+		return nil, nil
+	}
+	if pos <= 0 {
+		return nil, n
+	}
+	if pos >= n.length {
+		return n, nil
+	}
+
+	if n.isLeaf() {
+		// Leaves are shared between ropes, slice them without writing
+		return newLeaf(n.text[:pos:pos]), newLeaf(n.text[pos:])
+	}
+
+	if pos < n.left.length {
+		left, right := split(n.left, pos)
+		return left, join(right, n.right)
+	}
+
+	left, right := split(n.right, pos-n.left.length)
+	return join(n.left, left), right
+}
+
+// join concatenates two trees, keeping the result balanced
+func join(left, right *node) *node {
+	if left == nil {
+		return right
+	}
+	if right == nil {
+		return left
+	}
+
+	if left.isLeaf() && right.isLeaf() && left.length+right.length <= maxLeafLength {
+		merged := make([]rune, 0, left.length+right.length)
+		merged = append(merged, left.text...)
+		merged = append(merged, right.text...)
+		return newLeaf(merged)
+	}
+
+	switch {
+	case left.height > right.height+1:
+		return rebalance(newBranch(left.left, join(left.right, right)))
+	case right.height > left.height+1:
+		return rebalance(newBranch(join(left, right.left), right.right))
+	}
+	return newBranch(left, right)
+}
+
+// rebalance restores the AVL invariant of a branch whose children differ by at most 2 in height
+func rebalance(n *node) *node {
+	switch {
+	case height(n.left) > height(n.right)+1:
+		left := n.left
+		if height(left.left) < height(left.right) {
+			left = rotateLeft(left)
+		}
+		return rotateRight(newBranch(left, n.right))
+	case height(n.right) > height(n.left)+1:
+		right := n.right
+		if height(right.right) < height(right.left) {
+			right = rotateRight(right)
+		}
+		return rotateLeft(newBranch(n.left, right))
+	}
+	return n
+}
+
+func rotateRight(n *node) *node {
+	return newBranch(n.left.left, newBranch(n.left.right, n.right))
+}
+
+func rotateLeft(n *node) *node {
+	return newBranch(newBranch(n.left, n.right.left), n.right.right)
+}
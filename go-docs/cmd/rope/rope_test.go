@@ -0,0 +1,262 @@
+package rope
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// Document sizes in runes, from a note to a book
+var benchmarkSizes = []int{1 << 10, 1 << 14, 1 << 17, 1 << 20}
+
+// benchmarkText is size runes long, the emoji makes UTF-16 and runes differ
+func benchmarkText(size int) string {
+	return string([]rune(strings.Repeat("lorem ipsum dolor sit amet, 😀 consectetur ", size/42+1))[:size])
+}
+
+// What UpdatedContent used to do for every keystroke
+func stringInsert(content string, pos int, text string) string {
+	runes := []rune(content)
+	return string(runes[:pos]) + text + string(runes[pos:])
+}
+
+func stringDelete(content string, pos, length int) string {
+	runes := []rune(content)
+	return string(runes[:pos]) + string(runes[pos+length:])
+}
+
+func BenchmarkInsert(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		text := benchmarkText(size)
+		length := len([]rune(text))
+
+		b.Run(fmt.Sprintf("rope/%d", size), func(b *testing.B) {
+			rng := rand.New(rand.NewSource(1))
+			content := New(text)
+			for i := 0; i < b.N; i++ {
+				content = content.Insert(rng.Intn(content.Len()+1), "a")
+				if content.Len() > 2*length {
+					content = New(text)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("string/%d", size), func(b *testing.B) {
+			rng := rand.New(rand.NewSource(1))
+			content := text
+			for i := 0; i < b.N; i++ {
+				content = stringInsert(content, rng.Intn(length+1), "a")
+			}
+		})
+	}
+}
+
+func BenchmarkDelete(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		text := benchmarkText(size)
+		length := len([]rune(text))
+
+		b.Run(fmt.Sprintf("rope/%d", size), func(b *testing.B) {
+			rng := rand.New(rand.NewSource(1))
+			content := New(text)
+			for i := 0; i < b.N; i++ {
+				if content.Len() < length/2 {
+					content = New(text)
+				}
+				content = content.Delete(rng.Intn(content.Len()), 1)
+			}
+		})
+
+		b.Run(fmt.Sprintf("string/%d", size), func(b *testing.B) {
+			rng := rand.New(rand.NewSource(1))
+			for i := 0; i < b.N; i++ {
+				stringDelete(text, rng.Intn(length), 1)
+			}
+		})
+	}
+}
+
+// Mapping a browser offset, done for every operation and cursor from a UTF-16 client
+func BenchmarkUTF16ToRune(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		content := New(benchmarkText(size))
+
+		b.Run(fmt.Sprintf("rope/%d", size), func(b *testing.B) {
+			rng := rand.New(rand.NewSource(1))
+			for i := 0; i < b.N; i++ {
+				content.UTF16ToRune(rng.Intn(content.UTF16Len() + 1))
+			}
+		})
+	}
+}
+
+// Paid once per flush instead of once per operation
+func BenchmarkString(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		content := New(benchmarkText(size))
+
+		b.Run(fmt.Sprintf("rope/%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_ = content.String()
+			}
+		})
+	}
+}
+
+// checkRope compares r with the reference runes and checks the tree invariants
+func checkRope(t *testing.T, r *Rope, want []rune) {
+	t.Helper()
+
+	if got := r.String(); got != string(want) {
+		t.Fatalf("String() = %q, want %q", got, string(want))
+	}
+	if got := string(r.Runes()); got != string(want) {
+		t.Fatalf("Runes() = %q, want %q", got, string(want))
+	}
+	if r.Len() != len(want) {
+		t.Fatalf("Len() = %d, want %d", r.Len(), len(want))
+	}
+	if got, wantUTF16 := r.UTF16Len(), len(utf16.Encode(want)); got != wantUTF16 {
+		t.Fatalf("UTF16Len() = %d, want %d", got, wantUTF16)
+	}
+	checkNode(t, r.root)
+}
+
+func checkNode(t *testing.T, n *node) {
+	t.Helper()
+
+	if n == nil {
+		return
+	}
+	if n.isLeaf() {
+		if n.length != len(n.text) || n.length == 0 || n.length > maxLeafLength {
+			t.Fatalf("leaf of %d runes counts %d", len(n.text), n.length)
+		}
+		if n.utf16 != len(utf16.Encode(n.text)) {
+			t.Fatalf("leaf %q counts %d UTF-16 units", string(n.text), n.utf16)
+		}
+		return
+	}
+
+	if n.left == nil || n.right == nil {
+		t.Fatalf("branch with a missing child")
+	}
+	checkNode(t, n.left)
+	checkNode(t, n.right)
+	if n.length != n.left.length+n.right.length || n.utf16 != n.left.utf16+n.right.utf16 {
+		t.Fatalf("branch counts do not add up")
+	}
+	if n.height != max(n.left.height, n.right.height)+1 {
+		t.Fatalf("branch height %d, children %d and %d", n.height, n.left.height, n.right.height)
+	}
+	if diff := n.left.height - n.right.height; diff > 1 || diff < -1 {
+		t.Fatalf("unbalanced branch, children of height %d and %d", n.left.height, n.right.height)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, text := range []string{"", "a", "héllo 😀 wörld", benchmarkText(5000)} {
+		checkRope(t, New(text), []rune(text))
+	}
+}
+
+func TestInsertAndDelete(t *testing.T) {
+	r := New("ac")
+	r = r.Insert(1, "b")
+	checkRope(t, r, []rune("abc"))
+	r = r.Insert(0, "😀")
+	checkRope(t, r, []rune("😀abc"))
+	r = r.Insert(r.Len(), "😀")
+	checkRope(t, r, []rune("😀abc😀"))
+	r = r.Delete(0, 2)
+	checkRope(t, r, []rune("bc😀"))
+	r = r.Delete(1, 2)
+	checkRope(t, r, []rune("b"))
+	r = r.Delete(0, 1)
+	checkRope(t, r, []rune(""))
+}
+
+func TestEditsKeepOlderRopes(t *testing.T) {
+	before := New("hello")
+	after := before.Insert(5, " 😀").Delete(0, 1)
+
+	checkRope(t, before, []rune("hello"))
+	checkRope(t, after, []rune("ello 😀"))
+}
+
+// Random edits on a rope and on a plain rune slice must always agree
+func TestAgainstRuneSlice(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	alphabet := []rune("ab é😀𝄞\n")
+
+	randomText := func(maxLength int) string {
+		text := make([]rune, 1+rng.Intn(maxLength))
+		for i := range text {
+			text[i] = alphabet[rng.Intn(len(alphabet))]
+		}
+		return string(text)
+	}
+
+	want := []rune(randomText(2000))
+	r := New(string(want))
+	for i := 0; i < 2000; i++ {
+		if len(want) == 0 || rng.Intn(2) == 0 {
+			pos := rng.Intn(len(want) + 1)
+			// Mostly keystrokes, sometimes a paste bigger than a leaf
+			text := randomText(3)
+			if rng.Intn(50) == 0 {
+				text = randomText(3 * maxLeafLength)
+			}
+			r = r.Insert(pos, text)
+			want = append(want[:pos:pos], append([]rune(text), want[pos:]...)...)
+		} else {
+			pos := rng.Intn(len(want))
+			length := 1 + rng.Intn(min(len(want)-pos, 2*maxLeafLength))
+			r = r.Delete(pos, length)
+			want = append(want[:pos:pos], want[pos+length:]...)
+		}
+
+		checkRope(t, r, want)
+
+		start := rng.Intn(len(want) + 1)
+		end := start + rng.Intn(len(want)-start+1)
+		if got := r.Slice(start, end); got != string(want[start:end]) {
+			t.Fatalf("Slice(%d, %d) = %q, want %q", start, end, got, string(want[start:end]))
+		}
+	}
+}
+
+func TestUTF16Offsets(t *testing.T) {
+	text := []rune(strings.Repeat("a😀é𝄞", 300))
+	r := New(string(text))
+
+	offset := 0
+	for pos, char := range text {
+		if got := r.RuneToUTF16(pos); got != offset {
+			t.Fatalf("RuneToUTF16(%d) = %d, want %d", pos, got, offset)
+		}
+		if got, ok := r.UTF16ToRune(offset); !ok || got != pos {
+			t.Fatalf("UTF16ToRune(%d) = %d, %v, want %d", offset, got, ok, pos)
+		}
+
+		offset += utf16.RuneLen(char)
+		if utf16.RuneLen(char) == 2 {
+			// Between the two halves of a surrogate pair
+			if _, ok := r.UTF16ToRune(offset - 1); ok {
+				t.Fatalf("UTF16ToRune(%d) accepted the middle of %q", offset-1, char)
+			}
+		}
+	}
+
+	if got := r.RuneToUTF16(len(text)); got != offset {
+		t.Fatalf("RuneToUTF16(end) = %d, want %d", got, offset)
+	}
+	if got, ok := r.UTF16ToRune(offset); !ok || got != len(text) {
+		t.Fatalf("UTF16ToRune(end) = %d, %v, want %d", got, ok, len(text))
+	}
+	if _, ok := r.UTF16ToRune(offset + 1); ok {
+		t.Fatalf("UTF16ToRune accepted an offset past the end")
+	}
+}
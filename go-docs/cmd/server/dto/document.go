@@ -2,6 +2,9 @@ package dto
 
 import (
 	"go-docs/cmd/models"
+	"time"
+
+	"github.com/google/uuid"
 )
 
 type CreateDocumentRequest struct {
@@ -14,6 +17,13 @@ type CreateDocumentResponse struct {
 	Message string `json:"message"`
 }
 
+type ForkDocumentRequest struct {
+	Title         string `json:"title" validate:"max=255"` // "Copy of" the parent title when left out
+	Version       *int   `json:"version"`                  // The live version when left out
+	Collaborators bool   `json:"collaborators"`            // Share the fork with the collaborators of the parent
+	History       bool   `json:"history"`                  // Keep the operation log, checkpoints and named versions up to the fork
+}
+
 type AddCollaboratorRequest struct {
 	UserID string             `json:"userID"`
 	Access models.AccessLevel `json:"access"`
@@ -27,3 +37,89 @@ type GetCollaboratorsResponse struct {
 type RemoveCollaboratorRequest struct {
 	UserID string `json:"userID"`
 }
+
+type UpdateCollaboratorRequest struct {
+	UserID string             `json:"userID"`
+	Access models.AccessLevel `json:"access"`
+}
+
+// Revision groups consecutive operations of one author, Version is the last of them
+type Revision struct {
+	FromVersion    int                       `json:"from_version"`
+	Version        int                       `json:"version"`
+	Author         models.User               `json:"author"`
+	StartedAt      time.Time                 `json:"started_at"`
+	EndedAt        time.Time                 `json:"ended_at"`
+	OperationCount int                       `json:"operation_count"`
+	Snapshots      []models.DocumentSnapshot `json:"snapshots"` // Named versions pinned within this revision
+}
+
+type HistoryResponse struct {
+	Revisions []Revision `json:"revisions"`
+	Page      int        `json:"page"`
+	Limit     int        `json:"limit"`
+	Total     int64      `json:"total"`
+}
+
+type DocumentVersionResponse struct {
+	DocumentID string    `json:"document_id"`
+	Version    int       `json:"version"`
+	Content    string    `json:"content"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+type RestoreVersionResponse struct {
+	DocumentID      string `json:"document_id"`
+	RestoredVersion int    `json:"restored_version"`
+	Version         int    `json:"version"` // The document version once restored
+	OperationCount  int    `json:"operation_count"`
+}
+
+type DiffChange struct {
+	Kind string `json:"kind"` // equal, insert or delete
+	Text string `json:"text"`
+}
+
+// DiffHunk is a changed region with some unchanged context around it, offsets are in runes
+type DiffHunk struct {
+	FromStart  int          `json:"from_start"`
+	FromLength int          `json:"from_length"`
+	ToStart    int          `json:"to_start"`
+	ToLength   int          `json:"to_length"`
+	Changes    []DiffChange `json:"changes"`
+}
+
+type DiffResponse struct {
+	DocumentID  string     `json:"document_id"`
+	From        int        `json:"from"`
+	To          int        `json:"to"`
+	Granularity string     `json:"granularity"`
+	Hunks       []DiffHunk `json:"hunks"`
+}
+
+type CreateSnapshotRequest struct {
+	Version     *int   `json:"version"` // The live version when left out
+	Name        string `json:"name" validate:"required,max=100"`
+	Description string `json:"description" validate:"max=1000"`
+}
+
+type UpdateSnapshotRequest struct {
+	Name        string `json:"name" validate:"required,max=100"`
+	Description string `json:"description" validate:"max=1000"`
+}
+
+// BlameRange is [Start, End) of the content, written by UserID and last touched at Version
+type BlameRange struct {
+	Start   int       `json:"start"`
+	End     int       `json:"end"`
+	UserID  uuid.UUID `json:"user_id"`
+	Name    string    `json:"name"`
+	Version int       `json:"version"`
+}
+
+type BlameResponse struct {
+	DocumentID string       `json:"document_id"`
+	Version    int          `json:"version"`
+	Units      string       `json:"units"` // What Start and End count
+	Ranges     []BlameRange `json:"ranges"`
+}
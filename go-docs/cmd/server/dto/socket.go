@@ -0,0 +1,62 @@
+package dto
+
+import (
+	"go-docs/cmd/models"
+
+	"github.com/google/uuid"
+)
+
+type SocketMessageType string
+
+const (
+	SocketMessageTypeDocument  SocketMessageType = "document"
+	SocketMessageTypeOperation SocketMessageType = "operation"
+	SocketMessageTypeAck       SocketMessageType = "ack"
+	SocketMessageTypeError     SocketMessageType = "error"
+	SocketMessageTypeCursor    SocketMessageType = "cursor"
+	SocketMessageTypePresence  SocketMessageType = "presence"
+	SocketMessageTypeJoin      SocketMessageType = "join"
+	SocketMessageTypeLeave     SocketMessageType = "leave"
+	SocketMessageTypeResync    SocketMessageType = "resync"
+	// A client with suggest access sends its edits as "suggest", everybody is
+	// then sent the "suggestion" and later how it was resolved
+	SocketMessageTypeSuggest            SocketMessageType = "suggest"
+	SocketMessageTypeSuggestion         SocketMessageType = "suggestion"
+	SocketMessageTypeSuggestionResolved SocketMessageType = "suggestion_resolved"
+	// Sent when the role of the user changes, a revoked user is disconnected instead
+	SocketMessageTypeAccess SocketMessageType = "access"
+)
+
+// Every frame on the document socket, in both directions, is a SocketMessage.
+// Only the fields relevant to Type are set.
+type SocketMessage struct {
+	Type        SocketMessageType           `json:"type"`
+	Document    *models.Document            `json:"document,omitempty"`
+	Operation   *models.DocumentOperation   `json:"operation,omitempty"`
+	Operations  []models.DocumentOperation  `json:"operations,omitempty"`
+	Version     int                         `json:"version"` // Always sent, a new document is at version 0
+	OperationID string                      `json:"operation_id,omitempty"`
+	Cursor      *Cursor                     `json:"cursor,omitempty"`
+	Presence    *Presence                   `json:"presence,omitempty"`
+	Presences   []Presence                  `json:"presences,omitempty"`
+	Error       *ErrorResponse              `json:"error,omitempty"`
+	Units       string                      `json:"units,omitempty"` // Position unit the server settled on, sent with the document
+	Suggestion  *models.DocumentSuggestion  `json:"suggestion,omitempty"`
+	Suggestions []models.DocumentSuggestion `json:"suggestions,omitempty"` // Pending ones, sent with the document
+	Access      models.AccessLevel          `json:"access,omitempty"`      // What the user may do, sent with the document and when it changes
+}
+
+type Cursor struct {
+	Pos            int `json:"pos"`
+	SelectionStart int `json:"selection_start"`
+	SelectionEnd   int `json:"selection_end"`
+	BaseVersion    int `json:"base_version,omitempty"` // Version the client positions refer to, like an operation. Shared cursors are always on the live document.
+}
+
+type Presence struct {
+	ClientID string    `json:"client_id"`
+	UserID   uuid.UUID `json:"user_id"`
+	Name     string    `json:"name"`
+	Color    string    `json:"color"`
+	Cursor   *Cursor   `json:"cursor,omitempty"`
+}
@@ -2,11 +2,14 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
+	"go-docs/cmd/models"
 	"go-docs/cmd/server/dto"
 	"go-docs/cmd/server/middleware"
 	"go-docs/cmd/server/validator"
 	"go-docs/cmd/services"
 	"go-docs/cmd/utils"
+	"io"
 	"log"
 	"net/http"
 	"strconv"
@@ -43,10 +46,10 @@ func (h *DocumentHandler) CreateDocument(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	documentID, err := h.documentService.CreateDocument(document.Title, document.Content, documentID, userID)
+	documentID, err := h.documentService.CreateDocument(r.Context(), document.Title, document.Content, documentID, userID)
 
 	if err != nil {
-		utils.GetErrorResponse("Internal Server Error", err.Error(), w, http.StatusInternalServerError)
+		documentError(w, err)
 		return
 	}
 
@@ -84,10 +87,10 @@ func (h *DocumentHandler) GetDocument(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	documents, err := h.documentService.GetDocument(userID, documentID)
-	log.Println("Get Document Error: ", err)
+	documents, err := h.documentService.GetDocument(r.Context(), userID, documentID)
 	if err != nil {
-		utils.GetErrorResponse("Internal Server Error", err.Error(), w, http.StatusInternalServerError)
+		log.Println("Get Document Error: ", err)
+		documentError(w, err)
 		return
 	}
 
@@ -97,6 +100,12 @@ func (h *DocumentHandler) GetDocument(w http.ResponseWriter, r *http.Request) {
 
 func (h *DocumentHandler) AddCollaborator(w http.ResponseWriter, r *http.Request) {
 	documentID := chi.URLParam(r, "documentID")
+	userID, ok := middleware.GetUserIDFromContext(r.Context())
+	if !ok {
+		utils.GetErrorResponse("Unauthorized", "Unauthorized", w, http.StatusUnauthorized)
+		return
+	}
+
 	var addCollaboratorBody dto.AddCollaboratorRequest
 
 	if err := json.NewDecoder(r.Body).Decode(&addCollaboratorBody); err != nil {
@@ -104,8 +113,14 @@ func (h *DocumentHandler) AddCollaborator(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	if err := h.documentService.AddCollaborator(documentID, addCollaboratorBody.UserID, addCollaboratorBody.Access); err != nil {
-		utils.GetErrorResponse("Internal Server Error", err.Error(), w, http.StatusInternalServerError)
+	access, err := models.ParseAccessLevel(string(addCollaboratorBody.Access))
+	if err != nil {
+		utils.GetErrorResponse("Unprocessable Entity", err.Error(), w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	if err := h.documentService.AddCollaborator(r.Context(), userID, documentID, addCollaboratorBody.UserID, access); err != nil {
+		documentError(w, err)
 		return
 	}
 
@@ -114,10 +129,15 @@ func (h *DocumentHandler) AddCollaborator(w http.ResponseWriter, r *http.Request
 
 func (h *DocumentHandler) GetCollaborators(w http.ResponseWriter, r *http.Request) {
 	documentID := chi.URLParam(r, "documentID")
+	userID, ok := middleware.GetUserIDFromContext(r.Context())
+	if !ok {
+		utils.GetErrorResponse("Unauthorized", "Unauthorized", w, http.StatusUnauthorized)
+		return
+	}
 
-	collaborators, err := h.documentService.GetCollaborators(documentID)
+	collaborators, err := h.documentService.GetCollaborators(r.Context(), userID, documentID)
 	if err != nil {
-		utils.GetErrorResponse("Internal Server Error", err.Error(), w, http.StatusInternalServerError)
+		documentError(w, err)
 		return
 	}
 
@@ -141,8 +161,39 @@ func (h *DocumentHandler) RemoveCollaborator(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	if err := h.documentService.RemoveCollaborator(documentID, body.UserID, authorID); err != nil {
-		utils.GetErrorResponse("Internal Server Error", err.Error(), w, http.StatusInternalServerError)
+	if err := h.documentService.RemoveCollaborator(r.Context(), documentID, body.UserID, authorID); err != nil {
+		documentError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// UpdateCollaborator changes the role of a collaborator, read and write are still accepted as viewer and editor
+func (h *DocumentHandler) UpdateCollaborator(w http.ResponseWriter, r *http.Request) {
+	documentID := chi.URLParam(r, "documentID")
+	authorID, ok := middleware.GetUserIDFromContext(r.Context())
+
+	if !ok {
+		utils.GetErrorResponse("Unauthorized", "Unauthorized", w, http.StatusUnauthorized)
+		return
+	}
+
+	var body dto.UpdateCollaboratorRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		utils.GetErrorResponse("Bad Request", err.Error(), w, http.StatusBadRequest)
+		return
+	}
+
+	access, err := models.ParseAccessLevel(string(body.Access))
+	if err != nil {
+		utils.GetErrorResponse("Unprocessable Entity", err.Error(), w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	if err := h.documentService.UpdateCollaborator(r.Context(), documentID, body.UserID, authorID, access); err != nil {
+		documentError(w, err)
 		return
 	}
 
@@ -168,12 +219,51 @@ func (h *DocumentHandler) SearchUserForDocument(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	users, err := h.documentService.SearchUserForDocument(query, limitInt, documentID, userID)
+	users, err := h.documentService.SearchUserForDocument(r.Context(), query, limitInt, documentID, userID)
 	if err != nil {
-		utils.GetErrorResponse("Internal Server Error", err.Error(), w, http.StatusInternalServerError)
+		documentError(w, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(users)
 }
+
+// ForkDocument copies a document into a new one owned by the caller
+func (h *DocumentHandler) ForkDocument(w http.ResponseWriter, r *http.Request) {
+	documentID := chi.URLParam(r, "documentID")
+	var request dto.ForkDocumentRequest
+
+	// Every field is optional, so is the body
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		utils.GetErrorResponse("Bad Request", err.Error(), w, http.StatusBadRequest)
+		return
+	}
+
+	if err := h.validator.Struct(&request); err != nil {
+		utils.GetErrorResponse("Unprocessable Entity", err.Error(), w, http.StatusUnprocessableEntity)
+		return
+	}
+	if request.Version != nil && *request.Version < 0 {
+		utils.GetErrorResponse("Unprocessable Entity", "version must be a non negative number", w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	userID, ok := middleware.GetUserIDFromContext(r.Context())
+	if !ok {
+		utils.GetErrorResponse("Unauthorized", "Unauthorized", w, http.StatusUnauthorized)
+		return
+	}
+
+	forkID, err := h.documentService.ForkDocument(r.Context(), userID, documentID, request)
+	if err != nil {
+		documentError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(dto.CreateDocumentResponse{
+		ID:      forkID,
+		Message: "Document forked successfully",
+	})
+}
@@ -0,0 +1,216 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-docs/cmd/server/dto"
+	"go-docs/cmd/server/middleware"
+	"go-docs/cmd/services"
+	"go-docs/cmd/utils"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+// GetHistory lists the revisions of a document, ?page=1&limit=20 by default
+func (h *DocumentHandler) GetHistory(w http.ResponseWriter, r *http.Request) {
+	documentID := chi.URLParam(r, "documentID")
+	userID, ok := middleware.GetUserIDFromContext(r.Context())
+	if !ok {
+		utils.GetErrorResponse("Unauthorized", "Unauthorized", w, http.StatusUnauthorized)
+		return
+	}
+
+	page, err := queryInt(r, "page", 1)
+	if err != nil {
+		utils.GetErrorResponse("Bad Request", err.Error(), w, http.StatusBadRequest)
+		return
+	}
+	limit, err := queryInt(r, "limit", 20)
+	if err != nil {
+		utils.GetErrorResponse("Bad Request", err.Error(), w, http.StatusBadRequest)
+		return
+	}
+
+	history, err := h.documentService.GetHistory(r.Context(), userID, documentID, page, limit)
+	if err != nil {
+		documentError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(history)
+}
+
+func (h *DocumentHandler) GetVersion(w http.ResponseWriter, r *http.Request) {
+	documentID := chi.URLParam(r, "documentID")
+	userID, ok := middleware.GetUserIDFromContext(r.Context())
+	if !ok {
+		utils.GetErrorResponse("Unauthorized", "Unauthorized", w, http.StatusUnauthorized)
+		return
+	}
+
+	version, err := strconv.Atoi(chi.URLParam(r, "version"))
+	if err != nil || version < 0 {
+		utils.GetErrorResponse("Bad Request", "version must be a non negative number", w, http.StatusBadRequest)
+		return
+	}
+
+	documentVersion, err := h.documentService.GetVersion(r.Context(), userID, documentID, version)
+	if err != nil {
+		documentError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(documentVersion)
+}
+
+// RestoreVersion makes version the current content again, as new edits on top of the history
+func (h *DocumentHandler) RestoreVersion(w http.ResponseWriter, r *http.Request) {
+	documentID := chi.URLParam(r, "documentID")
+	userID, ok := middleware.GetUserIDFromContext(r.Context())
+	if !ok {
+		utils.GetErrorResponse("Unauthorized", "Unauthorized", w, http.StatusUnauthorized)
+		return
+	}
+
+	version, err := strconv.Atoi(chi.URLParam(r, "version"))
+	if err != nil || version < 0 {
+		utils.GetErrorResponse("Bad Request", "version must be a non negative number", w, http.StatusBadRequest)
+		return
+	}
+
+	restored, err := h.documentService.RestoreVersion(r.Context(), userID, documentID, version)
+	var resync *services.ResyncRequiredError
+	if errors.As(err, &resync) {
+		// The document moved too much while restoring, the client can simply retry
+		utils.GetErrorResponse("Conflict", err.Error(), w, http.StatusConflict)
+		return
+	} else if err != nil {
+		documentError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(restored)
+}
+
+/*
+GetDiff compares two versions, ?from=a&to=b with to defaulting to the live document:
+1. format=json (default) hunks, format=unified a line diff like diff -u, format=html
+the new content with <ins> and <del> markup
+2. granularity=word (default), char or line for json and html
+3. context=3 unchanged tokens kept around each hunk
+*/
+func (h *DocumentHandler) GetDiff(w http.ResponseWriter, r *http.Request) {
+	documentID := chi.URLParam(r, "documentID")
+	userID, ok := middleware.GetUserIDFromContext(r.Context())
+	if !ok {
+		utils.GetErrorResponse("Unauthorized", "Unauthorized", w, http.StatusUnauthorized)
+		return
+	}
+
+	if r.URL.Query().Get("from") == "" {
+		utils.GetErrorResponse("Bad Request", "from is required", w, http.StatusBadRequest)
+		return
+	}
+	from, err := queryInt(r, "from", 0)
+	if err != nil || from < 0 {
+		utils.GetErrorResponse("Bad Request", "from must be a non negative number", w, http.StatusBadRequest)
+		return
+	}
+	to, err := queryInt(r, "to", -1)
+	if err != nil || (to < 0 && r.URL.Query().Get("to") != "") {
+		utils.GetErrorResponse("Bad Request", "to must be a non negative number", w, http.StatusBadRequest)
+		return
+	}
+	contextLines, err := queryInt(r, "context", 3)
+	if err != nil || contextLines < 0 {
+		utils.GetErrorResponse("Bad Request", "context must be a non negative number", w, http.StatusBadRequest)
+		return
+	}
+	granularity, err := utils.ParseDiffGranularity(r.URL.Query().Get("granularity"))
+	if err != nil {
+		utils.GetErrorResponse("Bad Request", err.Error(), w, http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "unified" && format != "html" {
+		utils.GetErrorResponse("Bad Request", "format must be json, unified or html", w, http.StatusBadRequest)
+		return
+	}
+
+	fromContent, toContent, to, err := h.documentService.DiffContents(r.Context(), userID, documentID, from, to)
+	if err != nil {
+		documentError(w, err)
+		return
+	}
+
+	switch format {
+	case "unified":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fromName, toName := fmt.Sprintf("%s@%d", documentID, from), fmt.Sprintf("%s@%d", documentID, to)
+		w.Write([]byte(utils.UnifiedDiff(fromContent, toContent, fromName, toName, contextLines)))
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(utils.HTMLDiff(fromContent, toContent, granularity)))
+	default:
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(dto.DiffResponse{
+			DocumentID:  documentID,
+			From:        from,
+			To:          to,
+			Granularity: string(granularity),
+			Hunks:       utils.DiffHunks(fromContent, toContent, granularity, contextLines),
+		})
+	}
+}
+
+// GetBlame tells who wrote which part of the live document, in ?units= like the socket (runes by default)
+func (h *DocumentHandler) GetBlame(w http.ResponseWriter, r *http.Request) {
+	documentID := chi.URLParam(r, "documentID")
+	userID, ok := middleware.GetUserIDFromContext(r.Context())
+	if !ok {
+		utils.GetErrorResponse("Unauthorized", "Unauthorized", w, http.StatusUnauthorized)
+		return
+	}
+
+	unit, err := utils.ParsePositionUnit(r.URL.Query().Get("units"))
+	if err != nil {
+		utils.GetErrorResponse("Bad Request", err.Error(), w, http.StatusBadRequest)
+		return
+	}
+
+	blame, err := h.documentService.GetBlame(r.Context(), userID, documentID, unit)
+	if err != nil {
+		documentError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(blame)
+}
+
+func queryInt(r *http.Request, name string, fallback int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// documentError answers with the status matching a DocumentService error
+func documentError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrVersionNotFound), errors.Is(err, services.ErrCollaboratorNotFound), errors.Is(err, gorm.ErrRecordNotFound):
+		utils.GetErrorResponse("Not Found", err.Error(), w, http.StatusNotFound)
+	default:
+		middleware.AuthorizationError(w, err)
+	}
+}
@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"go-docs/cmd/server/dto"
+	"go-docs/cmd/server/middleware"
+	"go-docs/cmd/services"
+	"go-docs/cmd/utils"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// CreateSnapshot names a version, the live one unless the body has a version
+func (h *DocumentHandler) CreateSnapshot(w http.ResponseWriter, r *http.Request) {
+	documentID := chi.URLParam(r, "documentID")
+	var request dto.CreateSnapshotRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		utils.GetErrorResponse("Bad Request", err.Error(), w, http.StatusBadRequest)
+		return
+	}
+
+	if err := h.validator.Struct(&request); err != nil {
+		utils.GetErrorResponse("Unprocessable Entity", err.Error(), w, http.StatusUnprocessableEntity)
+		return
+	}
+	if request.Version != nil && *request.Version < 0 {
+		utils.GetErrorResponse("Unprocessable Entity", "version must be a non negative number", w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	userID, ok := middleware.GetUserIDFromContext(r.Context())
+	if !ok {
+		utils.GetErrorResponse("Unauthorized", "Unauthorized", w, http.StatusUnauthorized)
+		return
+	}
+
+	snapshot, err := h.documentService.CreateSnapshot(r.Context(), userID, documentID, request)
+	if err != nil {
+		snapshotError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+func (h *DocumentHandler) GetSnapshots(w http.ResponseWriter, r *http.Request) {
+	documentID := chi.URLParam(r, "documentID")
+	userID, ok := middleware.GetUserIDFromContext(r.Context())
+	if !ok {
+		utils.GetErrorResponse("Unauthorized", "Unauthorized", w, http.StatusUnauthorized)
+		return
+	}
+
+	snapshots, err := h.documentService.GetSnapshots(r.Context(), userID, documentID)
+	if err != nil {
+		snapshotError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(snapshots)
+}
+
+func (h *DocumentHandler) GetSnapshot(w http.ResponseWriter, r *http.Request) {
+	documentID := chi.URLParam(r, "documentID")
+	snapshotID := chi.URLParam(r, "snapshotID")
+	userID, ok := middleware.GetUserIDFromContext(r.Context())
+	if !ok {
+		utils.GetErrorResponse("Unauthorized", "Unauthorized", w, http.StatusUnauthorized)
+		return
+	}
+
+	snapshot, err := h.documentService.GetSnapshot(r.Context(), userID, documentID, snapshotID)
+	if err != nil {
+		snapshotError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+func (h *DocumentHandler) UpdateSnapshot(w http.ResponseWriter, r *http.Request) {
+	documentID := chi.URLParam(r, "documentID")
+	snapshotID := chi.URLParam(r, "snapshotID")
+	var request dto.UpdateSnapshotRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		utils.GetErrorResponse("Bad Request", err.Error(), w, http.StatusBadRequest)
+		return
+	}
+
+	if err := h.validator.Struct(&request); err != nil {
+		utils.GetErrorResponse("Unprocessable Entity", err.Error(), w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	userID, ok := middleware.GetUserIDFromContext(r.Context())
+	if !ok {
+		utils.GetErrorResponse("Unauthorized", "Unauthorized", w, http.StatusUnauthorized)
+		return
+	}
+
+	snapshot, err := h.documentService.UpdateSnapshot(r.Context(), userID, documentID, snapshotID, request)
+	if err != nil {
+		snapshotError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+func (h *DocumentHandler) DeleteSnapshot(w http.ResponseWriter, r *http.Request) {
+	documentID := chi.URLParam(r, "documentID")
+	snapshotID := chi.URLParam(r, "snapshotID")
+	userID, ok := middleware.GetUserIDFromContext(r.Context())
+	if !ok {
+		utils.GetErrorResponse("Unauthorized", "Unauthorized", w, http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.documentService.DeleteSnapshot(r.Context(), userID, documentID, snapshotID); err != nil {
+		snapshotError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func snapshotError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrSnapshotNameTaken):
+		utils.GetErrorResponse("Conflict", err.Error(), w, http.StatusConflict)
+	case errors.Is(err, services.ErrSnapshotNotFound):
+		utils.GetErrorResponse("Not Found", err.Error(), w, http.StatusNotFound)
+	default:
+		documentError(w, err)
+	}
+}
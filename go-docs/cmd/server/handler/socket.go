@@ -1,40 +1,274 @@
 package handler
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"go-docs/cmd/models"
+	"go-docs/cmd/rope"
+	"go-docs/cmd/server/dto"
+	"go-docs/cmd/server/middleware"
+	"go-docs/cmd/server/socket"
+	"go-docs/cmd/services"
 	"go-docs/cmd/utils"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+	"github.com/go-chi/chi/v5"
 )
 
+const socketWriteTimeout = 10 * time.Second
+
 type SocketHandler struct {
+	documentService *services.DocumentService
+	userService     *services.UserService
+	hub             *socket.Hub
+	policy          *services.Policy
 }
 
-func NewSocketHandler() *SocketHandler {
-	return &SocketHandler{}
+func NewSocketHandler(documentService *services.DocumentService, userService *services.UserService, hub *socket.Hub, policy *services.Policy) *SocketHandler {
+	return &SocketHandler{documentService: documentService, userService: userService, hub: hub, policy: policy}
 }
 
-func (h *SocketHandler) ServeTestWS(w http.ResponseWriter, r *http.Request) {
+/*
+1. Authenticate the user and make sure the document is reachable
+2. Negotiate the position unit with ?units=rune|utf16|grapheme, runes by default
+3. Subscribe to the document hub and send the current document in one step,
+so the client knows its base version
+4. Apply every incoming operation through OperationEvent, the hub acks it to
+the sender and sends the applied operations to everybody else
+5. Record every incoming suggestion through SuggestEvent, commenters can only
+send those and viewers neither. The role is resolved once on join and kept on
+the client, the hub updates it or closes the socket when the access changes
+6. Share cursor and selection updates with the other viewers, moved from the
+version the client counted them on onto the live document
+*/
+func (h *SocketHandler) ServeDocumentWS(w http.ResponseWriter, r *http.Request) {
+	documentID := chi.URLParam(r, "documentID")
+	userID, ok := middleware.GetUserIDFromContext(r.Context())
+	if !ok {
+		utils.GetErrorResponse("Unauthorized", "Unauthorized", w, http.StatusUnauthorized)
+		return
+	}
+
+	document, err := h.documentService.GetDocument(r.Context(), userID, documentID)
+	if err != nil {
+		documentError(w, err)
+		return
+	}
+
+	user, err := h.userService.GetUser(userID)
+	if err != nil {
+		utils.GetErrorResponse("Internal Server Error", err.Error(), w, http.StatusInternalServerError)
+		return
+	}
+
+	unit, err := utils.ParsePositionUnit(r.URL.Query().Get("units"))
+	if err != nil {
+		utils.GetErrorResponse("Bad Request", err.Error(), w, http.StatusBadRequest)
+		return
+	}
+
+	// Already looked up for this request by GetDocument
+	access, err := h.policy.Role(r.Context(), userID, documentID)
+	if err != nil {
+		documentError(w, err)
+		return
+	}
+
 	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
 		OriginPatterns: []string{os.Getenv("CLIENT_URL")},
 	})
 	if err != nil {
-		utils.GetErrorResponse("Internal Server Error", err.Error(), w, http.StatusInternalServerError)
+		log.Printf("Failed to accept websocket for document %s: %v", documentID, err)
 		return
 	}
 	defer c.Close(websocket.StatusNormalClosure, "")
 
+	ctx := r.Context()
+
+	var client *socket.Client
+	err = h.documentService.WithDocument(documentID, func(document models.Document, suggestions []models.DocumentSuggestion) {
+		content := rope.New(document.Content)
+		presences := socket.PresencesIn(h.hub.Presence(documentID), content, unit)
+		for i := range suggestions {
+			suggestions[i] = utils.ConvertSuggestion(content, suggestions[i], unit)
+		}
+
+		client = h.hub.Subscribe(documentID, *user, unit, access)
+		client.Send(dto.SocketMessage{
+			Type:        dto.SocketMessageTypeDocument,
+			Document:    &document,
+			Version:     document.Version,
+			Presences:   presences,
+			Units:       string(unit),
+			Suggestions: suggestions,
+			Access:      access,
+		})
+	})
+	if err != nil {
+		c.Close(websocket.StatusInternalError, err.Error())
+		return
+	}
+	defer h.hub.Unsubscribe(client)
+
+	go h.writeMessages(ctx, c, client)
+
 	for {
-		_, msg, err := c.Read(r.Context())
+		var msg dto.SocketMessage
+		if err := wsjson.Read(ctx, c, &msg); err != nil {
+			if websocket.CloseStatus(err) == -1 {
+				log.Printf("Socket read error for document %s: %v", documentID, err)
+			}
+			return
+		}
+
+		switch msg.Type {
+		case dto.SocketMessageTypeOperation, dto.SocketMessageTypeSuggest:
+			if msg.Operation == nil {
+				sendError(client, "Bad Request", "operation is required")
+				continue
+			}
+
+			// Never trust the client for who is editing what
+			op := *msg.Operation
+			op.DocumentID = document.ID
+			op.UserID = user.ID
+			op.Timestamp = time.Now()
+
+			// Commenters can only suggest, viewers neither. The role is the one
+			// resolved on join, updated by the hub whenever it changes.
+			capability := models.CapabilityEdit
+			if msg.Type == dto.SocketMessageTypeSuggest {
+				capability = models.CapabilityComment
+			}
+			if err := services.RequireCapability(client.Role(), capability); err != nil {
+				sendOperationError(client, op, "Forbidden", err.Error())
+				continue
+			}
+
+			if msg.Type == dto.SocketMessageTypeSuggest {
+				// Everybody, the sender included, gets the suggestion from the hub
+				_, err = h.documentService.SuggestEvent(op, client.Unit)
+			} else {
+				_, err = h.documentService.OperationEvent(op, client.ID, client.Unit)
+			}
+
+			// The client rebases its pending operations on what it missed and sends them again
+			var resync *services.ResyncRequiredError
+			var invalid *utils.InvalidOperationError
+			if errors.As(err, &resync) {
+				client.Send(dto.SocketMessage{
+					Type:       dto.SocketMessageTypeResync,
+					Operation:  &op,
+					Operations: resync.Operations,
+					Document:   resync.Document,
+					Version:    resync.Version,
+				})
+			} else if errors.As(err, &invalid) {
+				// Nothing was applied, the client drops the operation
+				client.Send(dto.SocketMessage{
+					Type:        dto.SocketMessageTypeError,
+					Operation:   &op,
+					OperationID: invalid.OperationID,
+					Error: &dto.ErrorResponse{
+						Title:   "Invalid Operation",
+						Message: invalid.Reason,
+					},
+				})
+			} else if err != nil {
+				sendError(client, "Internal Server Error", err.Error())
+			}
+		case dto.SocketMessageTypeCursor:
+			if msg.Cursor == nil {
+				sendError(client, "Bad Request", "cursor is required")
+				continue
+			}
+
+			// Counted on the version the client is at, moved onto the live document like its operations
+			var cursorErr error
+			err := h.documentService.WithContentSince(documentID, msg.Cursor.BaseVersion, func(base, content *rope.Rope, newerVersions []models.DocumentOperation) {
+				cursorErr = h.hub.UpdateCursor(client, *msg.Cursor, base, content, newerVersions)
+			})
+			var resync *services.ResyncRequiredError
+			if errors.As(err, &resync) {
+				// Too far behind to place it, the next cursor will do
+				continue
+			} else if err != nil {
+				sendError(client, "Internal Server Error", err.Error())
+			} else if cursorErr != nil {
+				sendError(client, "Bad Request", cursorErr.Error())
+			}
+		default:
+			sendError(client, "Bad Request", "unknown message type: "+string(msg.Type))
+		}
+	}
+}
+
+func (h *SocketHandler) GetPresence(w http.ResponseWriter, r *http.Request) {
+	documentID := chi.URLParam(r, "documentID")
+	userID, ok := middleware.GetUserIDFromContext(r.Context())
+	if !ok {
+		utils.GetErrorResponse("Unauthorized", "Unauthorized", w, http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.policy.Authorize(r.Context(), userID, documentID, models.CapabilityView); err != nil {
+		documentError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(h.hub.Presence(documentID))
+}
+
+// writeMessages is the only writer of the connection, it drains the client
+// queue until the hub closes it.
+func (h *SocketHandler) writeMessages(ctx context.Context, c *websocket.Conn, client *socket.Client) {
+	for msg := range client.Messages() {
+		writeCtx, cancel := context.WithTimeout(ctx, socketWriteTimeout)
+		err := wsjson.Write(writeCtx, c, msg)
+		cancel()
+
 		if err != nil {
-			utils.GetErrorResponse("Internal Server Error", err.Error(), w, http.StatusInternalServerError)
+			log.Printf("Socket write error for document %s: %v", client.DocumentID, err)
+			c.Close(websocket.StatusInternalError, "write failed")
 			return
 		}
+	}
 
-		log.Println("Received message: ", string(msg))
-		c.Write(r.Context(), websocket.MessageText, []byte("Hello, world!"))
+	if client.Overflowed() {
+		c.Close(websocket.StatusTryAgainLater, "too slow, reconnect to resync")
+	} else if client.Restarting() {
+		c.Close(websocket.StatusServiceRestart, "server restarting, reconnect")
+	} else if client.Revoked() {
+		c.Close(websocket.StatusPolicyViolation, "access to the document was revoked")
 	}
+}
 
+func sendError(client *socket.Client, title, message string) {
+	client.Send(dto.SocketMessage{
+		Type: dto.SocketMessageTypeError,
+		Error: &dto.ErrorResponse{
+			Title:   title,
+			Message: message,
+		},
+	})
+}
+
+// sendOperationError rejects op, nothing was applied and the client drops it
+func sendOperationError(client *socket.Client, op models.DocumentOperation, title, message string) {
+	client.Send(dto.SocketMessage{
+		Type:        dto.SocketMessageTypeError,
+		Operation:   &op,
+		OperationID: op.ID.String(),
+		Error: &dto.ErrorResponse{
+			Title:   title,
+			Message: message,
+		},
+	})
 }
@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"go-docs/cmd/models"
+	"go-docs/cmd/server/middleware"
+	"go-docs/cmd/services"
+	"go-docs/cmd/utils"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// GetSuggestions lists the suggestions of a document, ?status=pending by
+// default, the pending ones counted in ?units= like the socket
+func (h *DocumentHandler) GetSuggestions(w http.ResponseWriter, r *http.Request) {
+	documentID := chi.URLParam(r, "documentID")
+	userID, ok := middleware.GetUserIDFromContext(r.Context())
+	if !ok {
+		utils.GetErrorResponse("Unauthorized", "Unauthorized", w, http.StatusUnauthorized)
+		return
+	}
+
+	status := models.SuggestionStatus(r.URL.Query().Get("status"))
+	switch status {
+	case "":
+		status = models.SuggestionStatusPending
+	case models.SuggestionStatusPending, models.SuggestionStatusAccepted, models.SuggestionStatusRejected:
+	default:
+		utils.GetErrorResponse("Bad Request", "status must be pending, accepted or rejected", w, http.StatusBadRequest)
+		return
+	}
+
+	unit, err := utils.ParsePositionUnit(r.URL.Query().Get("units"))
+	if err != nil {
+		utils.GetErrorResponse("Bad Request", err.Error(), w, http.StatusBadRequest)
+		return
+	}
+
+	suggestions, err := h.documentService.GetSuggestions(r.Context(), userID, documentID, status, unit)
+	if err != nil {
+		suggestionError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(suggestions)
+}
+
+// AcceptSuggestion applies a pending suggestion to the document, only its author may
+func (h *DocumentHandler) AcceptSuggestion(w http.ResponseWriter, r *http.Request) {
+	documentID := chi.URLParam(r, "documentID")
+	suggestionID := chi.URLParam(r, "suggestionID")
+	userID, ok := middleware.GetUserIDFromContext(r.Context())
+	if !ok {
+		utils.GetErrorResponse("Unauthorized", "Unauthorized", w, http.StatusUnauthorized)
+		return
+	}
+
+	suggestion, err := h.documentService.AcceptSuggestion(r.Context(), userID, documentID, suggestionID)
+	if err != nil {
+		suggestionError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(suggestion)
+}
+
+// RejectSuggestion drops a pending suggestion, the document author or whoever suggested it may
+func (h *DocumentHandler) RejectSuggestion(w http.ResponseWriter, r *http.Request) {
+	documentID := chi.URLParam(r, "documentID")
+	suggestionID := chi.URLParam(r, "suggestionID")
+	userID, ok := middleware.GetUserIDFromContext(r.Context())
+	if !ok {
+		utils.GetErrorResponse("Unauthorized", "Unauthorized", w, http.StatusUnauthorized)
+		return
+	}
+
+	suggestion, err := h.documentService.RejectSuggestion(r.Context(), userID, documentID, suggestionID)
+	if err != nil {
+		suggestionError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(suggestion)
+}
+
+func suggestionError(w http.ResponseWriter, err error) {
+	var resync *services.ResyncRequiredError
+	var invalid *utils.InvalidOperationError
+
+	switch {
+	case errors.Is(err, services.ErrSuggestionNotFound):
+		utils.GetErrorResponse("Not Found", err.Error(), w, http.StatusNotFound)
+	case errors.Is(err, services.ErrSuggestionConflict), errors.As(err, &resync), errors.As(err, &invalid):
+		// The suggestion no longer fits the document, it is still pending
+		utils.GetErrorResponse("Conflict", err.Error(), w, http.StatusConflict)
+	default:
+		documentError(w, err)
+	}
+}
@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"errors"
+	"go-docs/cmd/models"
+	"go-docs/cmd/services"
+	"go-docs/cmd/utils"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+/*
+Authorize lets a request on /{documentID} through when the policy allows the
+user capability on the document. It runs after AuthMiddleware and leaves a
+role cache in the request context, so the services checking again for the same
+request do not go back to the DB.
+*/
+func Authorize(policy *services.Policy, capability models.Capability) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, ok := GetUserIDFromContext(r.Context())
+			if !ok {
+				utils.GetErrorResponse("Unauthorized", "Unauthorized", w, http.StatusUnauthorized)
+				return
+			}
+
+			ctx := services.WithPolicyCache(r.Context())
+			if err := policy.Authorize(ctx, userID, chi.URLParam(r, "documentID"), capability); err != nil {
+				AuthorizationError(w, err)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// AuthorizationError answers 404 for a missing document, 403 for a denied action and 500 otherwise
+func AuthorizationError(w http.ResponseWriter, err error) {
+	var capability *services.CapabilityError
+
+	switch {
+	case errors.Is(err, services.ErrDocumentNotFound):
+		utils.GetErrorResponse("Not Found", err.Error(), w, http.StatusNotFound)
+	case errors.Is(err, services.ErrNoDocumentAccess), errors.Is(err, services.ErrGrantAboveRole), errors.Is(err, services.ErrOwnerNotGrantable), errors.As(err, &capability):
+		utils.GetErrorResponse("Forbidden", err.Error(), w, http.StatusForbidden)
+	default:
+		utils.GetErrorResponse("Internal Server Error", err.Error(), w, http.StatusInternalServerError)
+	}
+}
@@ -1,11 +1,16 @@
 package server
 
 import (
+	"context"
+	"go-docs/cmd/models"
 	"go-docs/cmd/server/handler"
 	"go-docs/cmd/server/middleware"
+	"go-docs/cmd/server/socket"
 	"go-docs/cmd/server/validator"
 	"go-docs/cmd/services"
+	"log"
 	"os"
+	"sync"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/cors"
@@ -13,14 +18,40 @@ import (
 	"gorm.io/gorm"
 )
 
-func StartRestServer(db *gorm.DB, redis *redis.Client, userSearchTrie *services.UserSearchService) *chi.Mux {
+type RestServer struct {
+	Router          *chi.Mux
+	hub             *socket.Hub
+	documentService *services.DocumentService
+	stopWorkers     context.CancelFunc
+	workers         *sync.WaitGroup
+}
+
+// StartRestServer builds the routes and starts the background workers, they run
+// until ctx is done or the server shuts down
+func StartRestServer(ctx context.Context, db *gorm.DB, redis *redis.Client, userSearchTrie *services.UserSearchService) *RestServer {
 	r := chi.NewRouter()
 	validator := validator.NewValidator()
-	documentService := services.NewDocumentService(db, redis, userSearchTrie)
+	hub := socket.NewHub()
+	policy := services.NewPolicy(db)
+	documentService := services.NewDocumentService(db, redis, userSearchTrie, hub, policy)
 	userService := services.NewUserService(db, userSearchTrie)
 	userHandler := handler.NewUserHandler(userService, validator)
 	documentHandler := handler.NewDocumentHandler(documentService, validator)
-	socketHandler := handler.NewSocketHandler()
+	socketHandler := handler.NewSocketHandler(documentService, userService, hub, policy)
+
+	ctx, stopWorkers := context.WithCancel(ctx)
+	workers := &sync.WaitGroup{}
+	for _, worker := range []func(context.Context){
+		documentService.RelayOperations,
+		documentService.MaintainOwnership,
+		func(ctx context.Context) { documentService.RunFlusher(ctx, services.FlusherConfigFromEnv()) },
+	} {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			worker(ctx)
+		}()
+	}
 
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{os.Getenv("CLIENT_URL")},
@@ -44,19 +75,74 @@ func StartRestServer(db *gorm.DB, redis *redis.Client, userSearchTrie *services.
 		})
 		r.Route("/document", func(r chi.Router) {
 			r.Use(middleware.AuthMiddleware)
+			// Each route on a document says what the caller must be able to do with it
+			view := middleware.Authorize(policy, models.CapabilityView)
+			comment := middleware.Authorize(policy, models.CapabilityComment)
+			edit := middleware.Authorize(policy, models.CapabilityEdit)
+			export := middleware.Authorize(policy, models.CapabilityExport)
+			share := middleware.Authorize(policy, models.CapabilityShare)
+			manage := middleware.Authorize(policy, models.CapabilityManageCollaborators)
+
 			r.Post("/", documentHandler.CreateDocument)
-			r.Put("/{documentID}", documentHandler.CreateDocument)
+			r.With(edit).Put("/{documentID}", documentHandler.CreateDocument)
 			r.Get("/", documentHandler.GetDocuments)
-			r.Get("/{documentID}", documentHandler.GetDocument)
+			r.With(view).Get("/{documentID}", documentHandler.GetDocument)
+			r.With(view).Get("/{documentID}/ws", socketHandler.ServeDocumentWS)
+			r.With(view).Get("/{documentID}/presence", socketHandler.GetPresence)
+			r.With(view).Get("/{documentID}/history", documentHandler.GetHistory)
+			r.With(view).Get("/{documentID}/versions/{version}", documentHandler.GetVersion)
+			r.With(edit).Post("/{documentID}/versions/{version}/restore", documentHandler.RestoreVersion)
+			r.With(view).Get("/{documentID}/diff", documentHandler.GetDiff)
+			r.With(view).Get("/{documentID}/blame", documentHandler.GetBlame)
+			r.With(export).Post("/{documentID}/fork", documentHandler.ForkDocument)
+			r.Route("/{documentID}/suggestions", func(r chi.Router) {
+				r.With(view).Get("/", documentHandler.GetSuggestions)
+				r.With(manage).Post("/{suggestionID}/accept", documentHandler.AcceptSuggestion)
+				// Whoever made the suggestion may reject it too, RejectSuggestion checks the rest
+				r.With(comment).Post("/{suggestionID}/reject", documentHandler.RejectSuggestion)
+			})
+			r.Route("/{documentID}/snapshots", func(r chi.Router) {
+				r.With(edit).Post("/", documentHandler.CreateSnapshot)
+				r.With(view).Get("/", documentHandler.GetSnapshots)
+				r.With(view).Get("/{snapshotID}", documentHandler.GetSnapshot)
+				r.With(edit).Put("/{snapshotID}", documentHandler.UpdateSnapshot)
+				r.With(edit).Delete("/{snapshotID}", documentHandler.DeleteSnapshot)
+			})
 			r.Route("/colab", func(r chi.Router) {
-				r.Post("/{documentID}", documentHandler.AddCollaborator)
-				r.Get("/{documentID}", documentHandler.GetCollaborators)
-				r.Delete("/{documentID}", documentHandler.RemoveCollaborator)
-				r.Get("/search/{documentID}", documentHandler.SearchUserForDocument)
+				// AddCollaborator also keeps the role given within the role of the caller
+				r.With(share).Post("/{documentID}", documentHandler.AddCollaborator)
+				r.With(share).Get("/{documentID}", documentHandler.GetCollaborators)
+				r.With(manage).Put("/{documentID}", documentHandler.UpdateCollaborator)
+				r.With(manage).Delete("/{documentID}", documentHandler.RemoveCollaborator)
+				r.With(share).Get("/search/{documentID}", documentHandler.SearchUserForDocument)
 			})
 		})
-		r.Get("/test-ws", socketHandler.ServeTestWS)
 	})
 
-	return r
+	return &RestServer{Router: r, hub: hub, documentService: documentService, stopWorkers: stopWorkers, workers: workers}
+}
+
+/*
+Shutdown, it returns the documents that could not be saved to the DB:
+1. Close every socket with a reconnect hint and wait for them
+2. Stop the heartbeat, the relay and the forwarded operations, so nothing puts
+us back in the live node set or takes a lease once we let go of them
+3. Run a final flush, release the leases and leave the node set
+*/
+func (s *RestServer) Shutdown(ctx context.Context) []string {
+	s.hub.Shutdown(ctx)
+
+	s.stopWorkers()
+	stopped := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		log.Println("Background workers did not stop before the shutdown deadline")
+	}
+
+	return s.documentService.Shutdown(ctx)
 }
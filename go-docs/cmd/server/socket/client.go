@@ -0,0 +1,217 @@
+package socket
+
+import (
+	"fmt"
+	"go-docs/cmd/models"
+	"go-docs/cmd/server/dto"
+	"go-docs/cmd/utils"
+	"hash/fnv"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// Messages a client may have queued before it is considered too slow and dropped
+const sendQueueSize = 256
+
+var cursorColors = []string{
+	"#e6194b", "#3cb44b", "#4363d8", "#f58231", "#911eb4",
+	"#42d4f4", "#f032e6", "#469990", "#9a6324", "#800000",
+}
+
+type Client struct {
+	ID         string
+	DocumentID string
+	UserID     uuid.UUID
+	Name       string
+	Color      string
+	Unit       utils.PositionUnit // Counts every position it sends and receives
+
+	send       chan dto.SocketMessage
+	mu         sync.Mutex
+	closed     bool
+	overflowed bool
+	restarting bool
+	revoked    bool
+	cursor     *dto.Cursor
+	role       models.AccessLevel // Resolved on join, kept up to date by the hub
+}
+
+func newClient(documentID string, user models.User, unit utils.PositionUnit, role models.AccessLevel) *Client {
+	return &Client{
+		ID:         uuid.NewString(),
+		DocumentID: documentID,
+		UserID:     user.ID,
+		Name:       user.Name,
+		Color:      userColor(user.ID),
+		Unit:       unit,
+		send:       make(chan dto.SocketMessage, sendQueueSize),
+		role:       role,
+	}
+}
+
+// The same user always gets the same color, on every document and every node
+func userColor(userID uuid.UUID) string {
+	h := fnv.New32a()
+	fmt.Fprint(h, userID.String())
+	return cursorColors[h.Sum32()%uint32(len(cursorColors))]
+}
+
+func (c *Client) Presence() dto.Presence {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	presence := dto.Presence{
+		ClientID: c.ID,
+		UserID:   c.UserID,
+		Name:     c.Name,
+		Color:    c.Color,
+	}
+	if c.cursor != nil {
+		cursor := *c.cursor
+		presence.Cursor = &cursor
+	}
+	return presence
+}
+
+// Role is what the user may currently do on the document
+func (c *Client) Role() models.AccessLevel {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.role
+}
+
+func (c *Client) setRole(role models.AccessLevel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.role = role
+}
+
+func (c *Client) setCursor(cursor dto.Cursor) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cursor = &cursor
+}
+
+// transformCursor shifts the stored cursor through op, reporting whether it moved
+func (c *Client) transformCursor(op models.DocumentOperation) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cursor == nil {
+		return false
+	}
+
+	transformed := transformCursor(*c.cursor, op)
+	if transformed == *c.cursor {
+		return false
+	}
+
+	c.cursor = &transformed
+	return true
+}
+
+func transformCursor(cursor dto.Cursor, op models.DocumentOperation) dto.Cursor {
+	return dto.Cursor{
+		Pos:            utils.TransformPosition(cursor.Pos, op),
+		SelectionStart: utils.TransformPosition(cursor.SelectionStart, op),
+		SelectionEnd:   utils.TransformPosition(cursor.SelectionEnd, op),
+	}
+}
+
+// Send never blocks. When the queue is full the client is closed instead, since
+// skipping an operation would leave its document out of sync anyway.
+func (c *Client) Send(msg dto.SocketMessage) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return false
+	}
+
+	select {
+	case c.send <- msg:
+		return true
+	default:
+		c.overflowed = true
+		c.closed = true
+		close(c.send)
+		return false
+	}
+}
+
+// Messages is drained by the connection writer, it is closed once the client is gone
+func (c *Client) Messages() <-chan dto.SocketMessage {
+	return c.send
+}
+
+func (c *Client) Overflowed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.overflowed
+}
+
+// Restarting reports the client was closed because the server is shutting down
+func (c *Client) Restarting() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.restarting
+}
+
+// Revoked reports the client was closed because the user lost access to the document
+func (c *Client) Revoked() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.revoked
+}
+
+// closeOutOfSync drops a client we cannot tell about an operation in its unit,
+// it reconnects like one that fell behind.
+func (c *Client) closeOutOfSync() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.overflowed = true
+	c.closed = true
+	close(c.send)
+}
+
+func (c *Client) closeForRestart() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.restarting = true
+	c.closed = true
+	close(c.send)
+}
+
+// closeRevoked drops a client whose user no longer has access, it must not reconnect
+func (c *Client) closeRevoked() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.revoked = true
+	c.role = ""
+	c.closed = true
+	close(c.send)
+}
+
+func (c *Client) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.send)
+}
@@ -0,0 +1,308 @@
+package socket
+
+import (
+	"context"
+	"fmt"
+	"go-docs/cmd/models"
+	"go-docs/cmd/rope"
+	"go-docs/cmd/server/dto"
+	"go-docs/cmd/utils"
+	"log"
+	"sync"
+	"time"
+)
+
+// Hub keeps track of every socket connected to a document and fans out the
+// operations applied to it.
+type Hub struct {
+	mu           sync.RWMutex
+	rooms        map[string]map[string]*Client
+	shuttingDown bool
+}
+
+func NewHub() *Hub {
+	return &Hub{rooms: make(map[string]map[string]*Client)}
+}
+
+// Subscribe registers the user on the document, everybody already there is
+// told about the join. unit is what the client counts positions in, role what
+// the user may do on the document.
+func (h *Hub) Subscribe(documentID string, user models.User, unit utils.PositionUnit, role models.AccessLevel) *Client {
+	client := newClient(documentID, user, unit, role)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.shuttingDown {
+		client.closeForRestart()
+	}
+
+	room, ok := h.rooms[documentID]
+	if !ok {
+		room = make(map[string]*Client)
+		h.rooms[documentID] = room
+	}
+
+	presence := client.Presence()
+	for _, other := range room {
+		other.Send(dto.SocketMessage{Type: dto.SocketMessageTypeJoin, Presence: &presence})
+	}
+	room[client.ID] = client
+
+	return client
+}
+
+func (h *Hub) Unsubscribe(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if room, ok := h.rooms[client.DocumentID]; ok {
+		delete(room, client.ID)
+
+		presence := client.Presence()
+		for _, other := range room {
+			other.Send(dto.SocketMessage{Type: dto.SocketMessageTypeLeave, Presence: &presence})
+		}
+
+		if len(room) == 0 {
+			delete(h.rooms, client.DocumentID)
+		}
+	}
+	client.close()
+}
+
+func (h *Hub) Broadcast(documentID string, msg dto.SocketMessage, exceptID string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for id, client := range h.rooms[documentID] {
+		if id == exceptID {
+			continue
+		}
+		client.Send(msg)
+	}
+}
+
+/*
+Shutdown closes every client queue, their writers then send a close frame
+telling the browser to reconnect, to another instance if there is one. It
+returns once every connection is gone or ctx is done.
+*/
+func (h *Hub) Shutdown(ctx context.Context) {
+	h.mu.Lock()
+	h.shuttingDown = true
+	for _, room := range h.rooms {
+		for _, client := range room {
+			client.closeForRestart()
+		}
+	}
+	h.mu.Unlock()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		h.mu.RLock()
+		remaining := len(h.rooms)
+		h.mu.RUnlock()
+
+		if remaining == 0 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Printf("%d documents still had open sockets at shutdown", remaining)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Subscribers counts the connections open on the document
+func (h *Hub) Subscribers(documentID string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return len(h.rooms[documentID])
+}
+
+// Presence lists everybody currently connected to the document
+func (h *Hub) Presence(documentID string) []dto.Presence {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	presences := []dto.Presence{}
+	for _, client := range h.rooms[documentID] {
+		presences = append(presences, client.Presence())
+	}
+	return presences
+}
+
+/*
+UpdateCursor stores the client cursor and shares it with the other viewers.
+base is the document at cursor.BaseVersion, the one the client positions refer
+to, and newerVersions what was applied since to give content. The cursor is
+moved through them like an operation would be, cursors are kept in runes on
+the live document and converted for every viewer.
+*/
+func (h *Hub) UpdateCursor(client *Client, cursor dto.Cursor, base, content *rope.Rope, newerVersions []models.DocumentOperation) error {
+	cursor, ok := cursorToRunes(base, cursor, client.Unit)
+	if !ok {
+		return fmt.Errorf("cursor is not on a %s boundary of the document", client.Unit)
+	}
+	for _, op := range newerVersions {
+		cursor = transformCursor(cursor, op)
+	}
+	cursor.BaseVersion = 0
+	client.setCursor(cursor)
+
+	presence := []dto.Presence{client.Presence()}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for id, other := range h.rooms[client.DocumentID] {
+		if id == client.ID {
+			continue
+		}
+		converted := PresencesIn(presence, content, other.Unit)
+		other.Send(dto.SocketMessage{
+			Type:     dto.SocketMessageTypeCursor,
+			Presence: &converted[0],
+		})
+	}
+	return nil
+}
+
+/*
+BroadcastCommit is called by the DocumentService while it still holds the
+document lock, so every subscriber sees operations in version order. The
+sender gets a single "ack" with the version its operation committed at,
+everybody else one "operation" per applied operation. Stored cursors are
+moved through the operations and the ones that changed travel along with
+them, so remote cursors stay on the same text.
+Operations and cursors are converted into the unit of each subscriber, one
+we cannot convert for is closed and resyncs on reconnect.
+Sends only enqueue, a slow subscriber never blocks the caller.
+*/
+func (h *Hub) BroadcastCommit(commit models.OperationCommit, originID string) {
+	documentID := commit.DocumentID.String()
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	room := h.rooms[documentID]
+
+	converted := map[utils.PositionUnit][]models.DocumentOperation{}
+	for _, client := range room {
+		if _, ok := converted[client.Unit]; ok {
+			continue
+		}
+		// nil when they cannot be converted
+		converted[client.Unit], _ = commitOperationsIn(commit, client.Unit)
+	}
+
+	outOfSync := func(client *Client) bool {
+		if len(commit.Operations) > 0 && converted[client.Unit] == nil {
+			client.closeOutOfSync()
+			return true
+		}
+		return false
+	}
+
+	if origin, ok := room[originID]; ok && !outOfSync(origin) {
+		origin.Send(dto.SocketMessage{
+			Type:        dto.SocketMessageTypeAck,
+			OperationID: commit.OperationID.String(),
+			Operations:  converted[origin.Unit],
+			Version:     commit.Version,
+		})
+	}
+
+	for i, op := range commit.Operations {
+		movedCursors := []dto.Presence{}
+		for _, client := range room {
+			if client.transformCursor(op) {
+				movedCursors = append(movedCursors, client.Presence())
+			}
+		}
+
+		// Converted once per unit, not for every subscriber
+		movedIn := map[utils.PositionUnit][]dto.Presence{utils.PositionUnitRune: movedCursors}
+		for id, client := range room {
+			if id == originID || outOfSync(client) {
+				continue
+			}
+
+			clientOp := converted[client.Unit][i]
+			presences, ok := movedIn[client.Unit]
+			if !ok {
+				presences = PresencesIn(movedCursors, commit.Contents[i+1], client.Unit)
+				movedIn[client.Unit] = presences
+			}
+
+			client.Send(dto.SocketMessage{
+				Type:      dto.SocketMessageTypeOperation,
+				Operation: &clientOp,
+				Version:   op.Version,
+				Presences: presences,
+			})
+		}
+	}
+}
+
+// ResyncSubscribers closes every client of the document, they reconnect and
+// load it again. For when we cannot tell them what they missed.
+func (h *Hub) ResyncSubscribers(documentID string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, client := range h.rooms[documentID] {
+		client.closeOutOfSync()
+	}
+}
+
+/*
+BroadcastSuggestion sends a new suggestion, or how one was resolved, to every
+subscriber of the document. It is called with the document lock held, content
+being the document the anchor points into, converted for each subscriber.
+*/
+func (h *Hub) BroadcastSuggestion(suggestion models.DocumentSuggestion, content *rope.Rope) {
+	msgType := dto.SocketMessageTypeSuggestion
+	if suggestion.Status != models.SuggestionStatusPending {
+		msgType = dto.SocketMessageTypeSuggestionResolved
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, client := range h.rooms[suggestion.DocumentID.String()] {
+		converted := utils.ConvertSuggestion(content, suggestion, client.Unit)
+		client.Send(dto.SocketMessage{
+			Type:       msgType,
+			Suggestion: &converted,
+			Version:    suggestion.Version,
+		})
+	}
+}
+
+// BroadcastAccess gives every client of the user on the document their new
+// role, or closes them when the access was revoked. The handler checks the
+// role of its client before each operation, so a change applies to the next one.
+func (h *Hub) BroadcastAccess(change models.AccessChange) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, client := range h.rooms[change.DocumentID.String()] {
+		if client.UserID != change.UserID {
+			continue
+		}
+		if change.Access == "" {
+			client.closeRevoked()
+			continue
+		}
+		client.setRole(change.Access)
+		client.Send(dto.SocketMessage{Type: dto.SocketMessageTypeAccess, Access: change.Access})
+	}
+}
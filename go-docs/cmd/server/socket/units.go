@@ -0,0 +1,66 @@
+package socket
+
+import (
+	"go-docs/cmd/models"
+	"go-docs/cmd/rope"
+	"go-docs/cmd/server/dto"
+	"go-docs/cmd/utils"
+)
+
+// cursorToRunes converts a cursor counted in unit into runes, content being the document it points into
+func cursorToRunes(content *rope.Rope, cursor dto.Cursor, unit utils.PositionUnit) (dto.Cursor, bool) {
+	if unit == utils.PositionUnitRune {
+		return cursor, true
+	}
+
+	pos, posOk := utils.ToRuneOffset(content, cursor.Pos, unit)
+	start, startOk := utils.ToRuneOffset(content, cursor.SelectionStart, unit)
+	end, endOk := utils.ToRuneOffset(content, cursor.SelectionEnd, unit)
+
+	return dto.Cursor{Pos: pos, SelectionStart: start, SelectionEnd: end}, posOk && startOk && endOk
+}
+
+func cursorFromRunes(content *rope.Rope, cursor dto.Cursor, unit utils.PositionUnit) dto.Cursor {
+	return dto.Cursor{
+		Pos:            utils.FromRuneOffset(content, cursor.Pos, unit),
+		SelectionStart: utils.FromRuneOffset(content, cursor.SelectionStart, unit),
+		SelectionEnd:   utils.FromRuneOffset(content, cursor.SelectionEnd, unit),
+	}
+}
+
+// PresencesIn converts the cursors of presences into unit, content being the document they point into
+func PresencesIn(presences []dto.Presence, content *rope.Rope, unit utils.PositionUnit) []dto.Presence {
+	if unit == utils.PositionUnitRune {
+		return presences
+	}
+
+	converted := make([]dto.Presence, len(presences))
+	for i, presence := range presences {
+		if presence.Cursor != nil {
+			cursor := cursorFromRunes(content, *presence.Cursor, unit)
+			presence.Cursor = &cursor
+		}
+		converted[i] = presence
+	}
+	return converted
+}
+
+// commitOperationsIn converts the operations of commit into unit, which needs
+// the content around each of them
+func commitOperationsIn(commit models.OperationCommit, unit utils.PositionUnit) ([]models.DocumentOperation, bool) {
+	if unit == utils.PositionUnitRune || len(commit.Operations) == 0 {
+		return commit.Operations, true
+	}
+	if len(commit.Contents) != len(commit.Operations)+1 {
+		return nil, false
+	}
+
+	converted := make([]models.DocumentOperation, len(commit.Operations))
+	for i, op := range commit.Operations {
+		var err error
+		if converted[i], err = utils.ConvertOperation(commit.Contents[i], op, utils.PositionUnitRune, unit); err != nil {
+			return nil, false
+		}
+	}
+	return converted, true
+}
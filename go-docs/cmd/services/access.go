@@ -0,0 +1,166 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-docs/cmd/models"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrDocumentNotFound     = errors.New("document not found")
+	ErrNoDocumentAccess     = errors.New("you do not have access to this document")
+	ErrCollaboratorNotFound = errors.New("collaborator not found")
+	ErrGrantAboveRole       = errors.New("you cannot give a role that can do more than your own")
+	ErrOwnerNotGrantable    = errors.New("the owner role cannot be given, only the author owns a document")
+)
+
+// CapabilityError denies an action the role of the user on the document does not allow
+type CapabilityError struct {
+	Role       models.AccessLevel
+	Capability models.Capability
+}
+
+func (e *CapabilityError) Error() string {
+	return fmt.Sprintf("a document %s cannot %s", e.Role, strings.ReplaceAll(string(e.Capability), "_", " "))
+}
+
+// RequireCapability fails with a CapabilityError unless role allows capability
+func RequireCapability(role models.AccessLevel, capability models.Capability) error {
+	if !role.Can(capability) {
+		return &CapabilityError{Role: role, Capability: capability}
+	}
+	return nil
+}
+
+/*
+Policy answers whether a user can do something on a document, for the routes
+through the Authorize middleware and for the services themselves:
+1. The author of a document is its owner, a collaborator has the role stored with them
+2. A missing document is ErrDocumentNotFound, a user without a role ErrNoDocumentAccess
+3. What a role allows is the capability matrix of models
+*/
+type Policy struct {
+	db *gorm.DB
+}
+
+func NewPolicy(db *gorm.DB) *Policy {
+	return &Policy{db: db}
+}
+
+type policyCacheKey struct{}
+
+// roleCache remembers the roles looked up during one request, keyed by user and document
+type roleCache struct {
+	mu    sync.Mutex
+	roles map[string]roleLookup
+}
+
+type roleLookup struct {
+	role models.AccessLevel
+	err  error
+}
+
+// WithPolicyCache returns a context that remembers the roles the policy looks up with
+// it, a context that already does is returned as is
+func WithPolicyCache(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(policyCacheKey{}).(*roleCache); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, policyCacheKey{}, &roleCache{roles: map[string]roleLookup{}})
+}
+
+// Role returns the role of the user on the document
+func (p *Policy) Role(ctx context.Context, userID, documentID string) (models.AccessLevel, error) {
+	cache, ok := ctx.Value(policyCacheKey{}).(*roleCache)
+	if !ok {
+		return p.lookupRole(userID, documentID)
+	}
+
+	key := userID + ":" + documentID
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if lookup, ok := cache.roles[key]; ok {
+		return lookup.role, lookup.err
+	}
+
+	role, err := p.lookupRole(userID, documentID)
+	// A failing DB is worth asking again
+	if err == nil || errors.Is(err, ErrDocumentNotFound) || errors.Is(err, ErrNoDocumentAccess) {
+		cache.roles[key] = roleLookup{role: role, err: err}
+	}
+	return role, err
+}
+
+// Authorize lets the user through if their role on the document allows capability
+func (p *Policy) Authorize(ctx context.Context, userID, documentID string, capability models.Capability) error {
+	role, err := p.Role(ctx, userID, documentID)
+	if err != nil {
+		return err
+	}
+	return RequireCapability(role, capability)
+}
+
+func (p *Policy) lookupRole(userID, documentID string) (models.AccessLevel, error) {
+	if _, err := uuid.Parse(documentID); err != nil {
+		return "", ErrDocumentNotFound
+	}
+
+	document := &models.Document{}
+	err := p.db.Select("id, author_id").Where("id = ?", documentID).First(document).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", ErrDocumentNotFound
+	} else if err != nil {
+		return "", err
+	}
+	if document.AuthorID.String() == userID {
+		return models.AccessLevelOwner, nil
+	}
+
+	collaborator := &models.DocumentCollaborator{}
+	err = p.db.Where("document_id = ? AND user_id = ?", documentID, userID).First(collaborator).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", ErrNoDocumentAccess
+	} else if err != nil {
+		return "", err
+	}
+	return collaborator.Access, nil
+}
+
+// checkGrant fails unless role may give accessLevel to a collaborator
+func checkGrant(role, accessLevel models.AccessLevel) error {
+	if accessLevel == models.AccessLevelOwner {
+		return ErrOwnerNotGrantable
+	}
+	if !role.CanGrant(accessLevel) {
+		return ErrGrantAboveRole
+	}
+	return nil
+}
+
+// announceAccess tells the sessions of the user, on this instance and the others, about their new role
+func (s *DocumentService) announceAccess(change models.AccessChange) {
+	if s.broadcaster != nil {
+		s.broadcaster.BroadcastAccess(change)
+	}
+
+	data, err := json.Marshal(relayedCommit{NodeID: s.nodeID, Access: &change})
+	if err == nil {
+		err = s.redis.Publish(context.Background(), operationChannel(change.DocumentID.String()), data).Err()
+	}
+	if err != nil {
+		log.Printf("Failed to publish access change of %s on %s: %v", change.UserID.String(), change.DocumentID.String(), err)
+	}
+}
+
+// checkCapability is Policy.Authorize for the services
+func (s *DocumentService) checkCapability(ctx context.Context, userID, documentID string, capability models.Capability) error {
+	return s.policy.Authorize(ctx, userID, documentID, capability)
+}
@@ -0,0 +1,142 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"go-docs/cmd/models"
+	"go-docs/cmd/server/dto"
+	"go-docs/cmd/utils"
+	"log"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+/*
+GetBlame tells who wrote every part of the live document:
+1. Copy the authorship spans of the active document, they are never modified
+2. Turn them into ranges in unit, with the name of each author
+*/
+func (s *DocumentService) GetBlame(ctx context.Context, userID, documentID string, unit utils.PositionUnit) (*dto.BlameResponse, error) {
+	if err := s.checkCapability(ctx, userID, documentID, models.CapabilityView); err != nil {
+		return nil, err
+	}
+
+	cache, err := s.lockActiveDocument(documentID)
+	if err != nil {
+		return nil, err
+	}
+	spans, content, version := cache.Blame, cache.Content, cache.ActiveDocument.Version
+	cache.Mu.Unlock()
+
+	authorIDs := []uuid.UUID{}
+	for _, span := range spans {
+		authorIDs = append(authorIDs, span.UserID)
+	}
+	authors := []models.User{}
+	if err := s.db.Select("id, name").Where("id IN ?", authorIDs).Find(&authors).Error; err != nil {
+		return nil, err
+	}
+	namesByID := make(map[uuid.UUID]string, len(authors))
+	for _, author := range authors {
+		namesByID[author.ID] = author.Name
+	}
+
+	blame := &dto.BlameResponse{DocumentID: documentID, Version: version, Units: string(unit), Ranges: []dto.BlameRange{}}
+	bounds := make([]int, len(spans)+1)
+	for i, span := range spans {
+		bounds[i+1] = bounds[i] + span.Length
+	}
+	bounds = utils.FromRuneOffsets(content, bounds, unit)
+	for i, span := range spans {
+		blame.Ranges = append(blame.Ranges, dto.BlameRange{
+			Start:   bounds[i],
+			End:     bounds[i+1],
+			UserID:  span.UserID,
+			Name:    namesByID[span.UserID],
+			Version: span.Version,
+		})
+	}
+
+	return blame, nil
+}
+
+// applyBlame moves the authorship along with an operation applied to the cache, the cache lock must be held
+func applyBlame(cache *models.OperationCache, op models.DocumentOperation) {
+	if cache.Blame != nil {
+		cache.Blame = utils.ApplyBlame(cache.Blame, op)
+	}
+}
+
+/*
+loadBlame rebuilds the authorship of a freshly loaded document:
+1. Start from the saved blame, or from the oldest checkpoint all written by
+the document author
+2. Replay the operation log up to the cached version
+Should it not add up to the content, the author gets all of it from now on.
+*/
+func (s *DocumentService) loadBlame(cache *models.OperationCache) error {
+	document := cache.ActiveDocument
+
+	saved := models.DocumentBlame{}
+	err := s.db.Where("document_id = ? AND version <= ?", document.ID, document.Version).First(&saved).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		checkpoint := models.DocumentCheckpoint{}
+		err = s.db.Where("document_id = ? AND version <= ?", document.ID, document.Version).Order("version ASC").First(&checkpoint).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		saved = models.DocumentBlame{
+			Version: checkpoint.Version,
+			Spans:   utils.ApplyBlame(nil, models.DocumentOperation{Content: checkpoint.Content, UserID: document.AuthorID, Version: checkpoint.Version}),
+		}
+	} else if err != nil {
+		return err
+	}
+
+	ops := []models.DocumentOperation{}
+	err = s.db.Select("user_id, operation_type, content, pos, delete_len, version").
+		Where("document_id = ? AND version > ? AND version <= ?", document.ID, saved.Version, document.Version).
+		Order("version ASC").
+		Find(&ops).Error
+	if err != nil {
+		return err
+	}
+
+	spans := saved.Spans
+	for _, op := range ops {
+		spans = utils.ApplyBlame(spans, op)
+	}
+
+	if len(ops) != document.Version-saved.Version || utils.BlameLength(spans) != cache.Content.Len() {
+		log.Printf("Authorship of document %s does not add up at version %d, starting over", document.ID.String(), document.Version)
+		spans = utils.ApplyBlame(nil, models.DocumentOperation{Content: cache.Content.String(), UserID: document.AuthorID, Version: document.Version})
+	}
+	if spans == nil {
+		spans = []models.BlameSpan{}
+	}
+	cache.Blame = spans
+
+	if len(ops) > checkpointInterval {
+		s.saveBlame(cache)
+	}
+	return nil
+}
+
+// saveBlame stores the authorship of the cached document unless a newer one is there, the cache lock must be held
+func (s *DocumentService) saveBlame(cache *models.OperationCache) {
+	if cache.Blame == nil {
+		return
+	}
+
+	document := cache.ActiveDocument
+	err := s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "document_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"version", "spans", "updated_at"}),
+		Where:     clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: "document_blames.version <= excluded.version"}}},
+	}).Create(&models.DocumentBlame{DocumentID: document.ID, Version: document.Version, Spans: cache.Blame}).Error
+	if err != nil {
+		log.Printf("Failed to save the authorship of document %s: %v", document.ID.String(), err)
+	}
+}
@@ -4,30 +4,61 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"go-docs/cmd/models"
+	"go-docs/cmd/rope"
 	"go-docs/cmd/server/dto"
 	"go-docs/cmd/utils"
 	"log"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
 	"gorm.io/gorm"
 )
 
+// How many applied operations an active document keeps around to transform late ones
+const maxCachedOperations = 200
+
+// OperationBroadcaster is told about every operation committed to a document,
+// every suggestion made or resolved and every collaborator access changed.
+// It may be called while the document lock is held so it must never block.
+type OperationBroadcaster interface {
+	BroadcastCommit(commit models.OperationCommit, originID string)
+	BroadcastSuggestion(suggestion models.DocumentSuggestion, content *rope.Rope)
+	BroadcastAccess(change models.AccessChange)
+	ResyncSubscribers(documentID string)
+	Subscribers(documentID string) int
+}
+
 type DocumentService struct {
 	db             *gorm.DB
 	redis          *redis.Client
 	operationCache sync.Map
 	userSearchTrie *UserSearchService
+	broadcaster    OperationBroadcaster
+	nodeID         string // Identifies this instance on the redis channels and leases
+	ownership      *documentOwnership
+	policy         *Policy
 }
 
-func NewDocumentService(db *gorm.DB, redis *redis.Client, userSearchTrie *UserSearchService) *DocumentService {
-	return &DocumentService{db: db, redis: redis, operationCache: sync.Map{}, userSearchTrie: userSearchTrie}
+func NewDocumentService(db *gorm.DB, redis *redis.Client, userSearchTrie *UserSearchService, broadcaster OperationBroadcaster, policy *Policy) *DocumentService {
+	nodeID := uuid.NewString()
+	return &DocumentService{
+		db:             db,
+		redis:          redis,
+		operationCache: sync.Map{},
+		userSearchTrie: userSearchTrie,
+		broadcaster:    broadcaster,
+		nodeID:         nodeID,
+		ownership:      newDocumentOwnership(redis, nodeID),
+		policy:         policy,
+	}
 }
 
-func (s *DocumentService) CreateDocument(title, content, documentID, authorID string) (string, error) {
+func (s *DocumentService) CreateDocument(ctx context.Context, title, content, documentID, authorID string) (string, error) {
 	parsedAuthorID := uuid.MustParse(authorID)
 	newDocument := &models.Document{
 		Title:    title,
@@ -40,33 +71,62 @@ func (s *DocumentService) CreateDocument(title, content, documentID, authorID st
 		if err != nil {
 			return "", err
 		}
+		// History starts at the content the document was created with
+		if err := s.saveCheckpoint(newDocument.ID, newDocument.Version, newDocument.Content); err != nil {
+			return "", err
+		}
 		return newDocument.ID.String(), nil
 	}
 
-	result := s.db.Model(&models.Document{}).Where("id = ?", documentID).Updates(
-		newDocument,
-	)
-	if result.Error != nil {
-		return "", result.Error
+	if err := s.checkCapability(ctx, authorID, documentID, models.CapabilityEdit); err != nil {
+		return "", err
 	}
 
-	newDocument = &models.Document{}
-	result = s.db.Where("id = ?", documentID).First(newDocument)
+	// Only the title is written directly, the content changes like any other edit
+	result := s.db.Model(&models.Document{}).Where("id = ?", documentID).Update("title", title)
 	if result.Error != nil {
 		return "", result.Error
 	}
+	if result.RowsAffected == 0 {
+		return "", gorm.ErrRecordNotFound
+	}
 
-	s.operationCache.Store(documentID, &models.OperationCache{
-		ActiveDocument: newDocument,
-		Operations:     []models.DocumentOperation{},
-		LastUsed:       time.Now(),
-		Dirty:          false,
-	})
-	s.saveDocumentToRedis(newDocument)
+	if err := s.replaceContent(documentID, title, content, parsedAuthorID); err != nil {
+		return "", err
+	}
 
 	return documentID, nil
 }
 
+// replaceContent submits a whole new content as a single replace operation, so
+// it is versioned, logged and broadcast to the live editors.
+func (s *DocumentService) replaceContent(documentID, title, content string, userID uuid.UUID) error {
+	cache, err := s.lockActiveDocument(documentID)
+	if err != nil {
+		return err
+	}
+	cache.ActiveDocument.Title = title
+	current := cache.Snapshot()
+	cache.Mu.Unlock()
+
+	if current.Content == content {
+		return nil
+	}
+
+	_, err = s.OperationEvent(models.DocumentOperation{
+		ID:            uuid.New(),
+		DocumentID:    current.ID,
+		UserID:        userID,
+		OperationType: models.OperationTypeReplace,
+		Pos:           0,
+		DeleteLen:     utf8.RuneCountInString(current.Content),
+		Content:       content,
+		BaseVersion:   current.Version,
+		Timestamp:     time.Now(),
+	}, "", utils.PositionUnitRune)
+	return err
+}
+
 func (s *DocumentService) GetDocuments(authorID string) ([]models.Document, error) {
 	document := []models.Document{}
 	result := s.db.Preload("Author").Preload("Collaborator").Where("author_id = ?", authorID).Order("updated_at DESC").Find(&document)
@@ -78,30 +138,34 @@ func (s *DocumentService) GetDocuments(authorID string) ([]models.Document, erro
 	return document, nil
 }
 
-func (s *DocumentService) GetDocument(userId string, documentID string) (*models.Document, error) {
-	document := &models.Document{}
-	colab := &models.DocumentCollaborator{}
-
-	cache, err := s.getActiveDocument(documentID)
-	if err != nil {
+func (s *DocumentService) GetDocument(ctx context.Context, userId string, documentID string) (*models.Document, error) {
+	if err := s.checkCapability(ctx, userId, documentID, models.CapabilityView); err != nil {
 		return nil, err
 	}
 
-	document = cache.ActiveDocument
-	if document.AuthorID == uuid.MustParse(userId) {
-		return document, nil
-	}
-
-	colabResults := s.db.Where("document_id = ? AND user_id = ?", documentID, userId).First(colab)
-
-	if colabResults.Error != nil && !errors.Is(colabResults.Error, gorm.ErrRecordNotFound) {
-		return nil, colabResults.Error
+	// Copy under the lock so callers never observe a half applied operation
+	cache, err := s.lockActiveDocument(documentID)
+	if err != nil {
+		return nil, err
 	}
-	return document, nil
+	activeDocument := cache.Snapshot()
+	cache.Mu.Unlock()
 
+	return &activeDocument, nil
 }
 
-func (s *DocumentService) AddCollaborator(documentID, userID string, accessLevel models.AccessLevel) error {
+// AddCollaborator shares the document, callerID can give at most their own role
+func (s *DocumentService) AddCollaborator(ctx context.Context, callerID, documentID, userID string, accessLevel models.AccessLevel) error {
+	role, err := s.policy.Role(ctx, callerID, documentID)
+	if err != nil {
+		return err
+	}
+	if err := RequireCapability(role, models.CapabilityShare); err != nil {
+		return err
+	}
+	if err := checkGrant(role, accessLevel); err != nil {
+		return err
+	}
 
 	document := &models.Document{}
 	result := s.db.Where("id = ?", documentID).First(document)
@@ -141,7 +205,11 @@ func (s *DocumentService) AddCollaborator(documentID, userID string, accessLevel
 	return s.db.Create(collaborator).Error
 }
 
-func (s *DocumentService) GetCollaborators(documentID string) ([]dto.GetCollaboratorsResponse, error) {
+func (s *DocumentService) GetCollaborators(ctx context.Context, userID, documentID string) ([]dto.GetCollaboratorsResponse, error) {
+	if err := s.checkCapability(ctx, userID, documentID, models.CapabilityShare); err != nil {
+		return nil, err
+	}
+
 	collaborators := []models.DocumentCollaborator{}
 
 	result := s.db.Preload("User").Select("user, user_id, access").Where("document_id = ?", documentID).Find(&collaborators)
@@ -162,106 +230,305 @@ func (s *DocumentService) GetCollaborators(documentID string) ([]dto.GetCollabor
 	return collaboratorsResponse, nil
 }
 
-func (s *DocumentService) RemoveCollaborator(documentID, userID, authorID string) error {
+func (s *DocumentService) RemoveCollaborator(ctx context.Context, documentID, userID, authorID string) error {
+	if err := s.checkCapability(ctx, authorID, documentID, models.CapabilityManageCollaborators); err != nil {
+		return err
+	}
+
+	result := s.db.Where("document_id = ? AND user_id = ?", documentID, userID).
+		Delete(&models.DocumentCollaborator{})
 
-	document := &models.Document{}
-	result := s.db.Where("id = ?", documentID).First(document)
 	if result.Error != nil {
 		return result.Error
 	}
 
-	if document.AuthorID != uuid.MustParse(authorID) {
-		return errors.New("you are not the author of the document")
+	if result.RowsAffected == 0 {
+		return ErrCollaboratorNotFound
 	}
 
-	result = s.db.Where("document_id = ? AND user_id = ?", documentID, userID).
-		Delete(&models.DocumentCollaborator{})
+	s.announceAccess(models.AccessChange{DocumentID: uuid.MustParse(documentID), UserID: uuid.MustParse(userID)})
+	return nil
+}
+
+// UpdateCollaborator gives a collaborator another role, authorID must be allowed to
+// manage collaborators and can give at most their own role
+func (s *DocumentService) UpdateCollaborator(ctx context.Context, documentID, userID, authorID string, accessLevel models.AccessLevel) error {
+	role, err := s.policy.Role(ctx, authorID, documentID)
+	if err != nil {
+		return err
+	}
+	if err := RequireCapability(role, models.CapabilityManageCollaborators); err != nil {
+		return err
+	}
+	if err := checkGrant(role, accessLevel); err != nil {
+		return err
+	}
+
+	result := s.db.Model(&models.DocumentCollaborator{}).
+		Where("document_id = ? AND user_id = ?", documentID, userID).
+		Update("access", accessLevel)
 
 	if result.Error != nil {
 		return result.Error
 	}
 
 	if result.RowsAffected == 0 {
-		return errors.New("collaborator not found")
+		return ErrCollaboratorNotFound
 	}
 
+	s.announceAccess(models.AccessChange{DocumentID: uuid.MustParse(documentID), UserID: uuid.MustParse(userID), Access: accessLevel})
+	return nil
+}
+
+// WithDocument calls fn with a copy of the active document and its pending
+// suggestions while holding its lock, so a subscriber registered inside fn
+// cannot miss or repeat an operation and a position read inside fn matches the document.
+func (s *DocumentService) WithDocument(documentID string, fn func(document models.Document, suggestions []models.DocumentSuggestion)) error {
+	cache, err := s.lockActiveDocument(documentID)
+	if err != nil {
+		return err
+	}
+	defer cache.Mu.Unlock()
+
+	fn(cache.Snapshot(), append([]models.DocumentSuggestion{}, cache.Suggestions...))
+	return nil
+}
+
+// WithContentSince is WithDocument without materializing the text, for positions
+// a client counted on baseVersion: fn gets that version of the document, the live
+// one and the operations applied in between. A version outside the retained
+// window fails with a ResyncRequiredError.
+func (s *DocumentService) WithContentSince(documentID string, baseVersion int, fn func(base, content *rope.Rope, newerVersions []models.DocumentOperation)) error {
+	cache, err := s.lockActiveDocument(documentID)
+	if err != nil {
+		return err
+	}
+	defer cache.Mu.Unlock()
+
+	newerVersions := []models.DocumentOperation{}
+	if baseVersion != cache.ActiveDocument.Version {
+		if newerVersions, err = s.operationsSince(cache, baseVersion); err != nil {
+			return err
+		}
+	}
+
+	contents, err := contentsAround(cache.Content, newerVersions)
+	if err != nil {
+		return err
+	}
+
+	fn(contents[0], cache.Content, newerVersions)
 	return nil
 }
 
 /*
 1. We get the event from websocket
-2. Get the document from the redis or db
-3. Apply the OT to the document
-4. Save the document to the redis or db
+2. Find the node that owns the document, forward the operation if it is not us
+3. Get the document from the redis or db
+4. Apply the OT to the document
+5. Append the applied operations to the operation log
+6. Stream the operations to redis, which fails if our lease is gone
+7. Broadcast the applied operation to every subscriber of the document
+8. Publish it to the other instances
+
+The returned commit holds what op became after the transform and was actually
+applied, each operation with Version set to the document version it produced.
+There can be several or none of them. Submitting the same operation ID again
+commits nothing and returns the version it was first committed at. originID
+identifies the subscriber that sent it, empty when it does not come from a socket.
+The positions of op are counted in unit, the commit is always in runes.
 */
-func (s *DocumentService) OperationEvent(op models.DocumentOperation) error {
-	cache, err := s.getActiveDocument(op.DocumentID.String())
+func (s *DocumentService) OperationEvent(op models.DocumentOperation, originID string, unit utils.PositionUnit) (models.OperationCommit, error) {
+	return s.submitOperation(op, originID, unit, true)
+}
+
+// submitOperation applies op if we own the document. Operations forwarded by
+// another node are never forwarded again, the sender retries instead.
+func (s *DocumentService) submitOperation(op models.DocumentOperation, originID string, unit utils.PositionUnit, allowForward bool) (models.OperationCommit, error) {
+	ctx := context.Background()
+	documentID := op.DocumentID.String()
+	commit := models.OperationCommit{DocumentID: op.DocumentID, OperationID: op.ID}
+
+	if err := utils.ValidateOperation(op); err != nil {
+		return commit, err
+	}
+
+	owner, token, err := s.ownership.claim(ctx, documentID)
 	if err != nil {
-		return err
+		return commit, err
 	}
 
-	document := cache.ActiveDocument
-	cache.Mu.Lock()
+	if owner != s.nodeID {
+		if !allowForward {
+			return commit, errNotDocumentOwner
+		}
+		result, err := s.ownership.forward(ctx, owner, forwardedOperation{OriginID: originID, Unit: unit, Operation: op})
+		if err != nil {
+			return commit, err
+		}
+		return result.Commit, nil
+	}
+
+	cache, err := s.lockActiveDocument(documentID)
+	if err != nil {
+		return commit, err
+	}
 	defer cache.Mu.Unlock()
 
-	if op.BaseVersion < document.Version {
-		newerVersions := s.getOperationsSince(op.BaseVersion, document.ID)
+	// Somebody else may have written the document while we did not hold this lease
+	if cache.Fence != token {
+		if err := s.catchUp(cache); err != nil {
+			return commit, err
+		}
+		cache.Fence = token
+	}
+
+	document := cache.ActiveDocument
+
+	// A client resending after a reconnect only needs the ack
+	if version, ok := cache.Seen[op.ID]; ok {
+		commit.Version = version
+		commit.Duplicate = true
+		s.announceCommit(commit, originID)
+		return commit, nil
+	}
+
+	newerVersions := []models.DocumentOperation{}
+	if op.BaseVersion != document.Version {
+		newerVersions, err = s.operationsSince(cache, op.BaseVersion)
 
-		for _, newerOp := range newerVersions {
-			op = s.operationalTransform(op, newerOp)
+		var resync *ResyncRequiredError
+		if errors.As(err, &resync) {
+			return commit, resyncIn(resync, cache, unit)
+		} else if err != nil {
+			return commit, err
 		}
 	}
 
-	document.Content = utils.UpdatedContent(document.Content, op)
-	document.Version++
-	cache.Operations = append(cache.Operations, op)
-	if len(cache.Operations) > 200 {
-		cache.Operations = cache.Operations[len(cache.Operations)-200:]
+	op, err = operationToRunes(cache.Content, op, newerVersions, unit)
+	if err != nil {
+		return commit, err
+	}
+
+	ops := []models.DocumentOperation{op}
+	if op.BaseVersion != document.Version {
+		ops = s.operationalTransform(op, newerVersions)
+	}
+
+	if len(ops) == 0 {
+		// Entirely undone by concurrent operations, nothing to write
+		commit.Operations = ops
+		commit.Version = document.Version
+		commit.Contents = []*rope.Rope{cache.Content}
+		s.rememberOperation(cache, op.ID, document.Version)
+		s.announceCommit(commit, originID)
+		return commit, nil
+	}
+
+	// Every resulting operation gets its own version so replicas can replay them one by one.
+	// Ropes are never modified, an invalid operation leaves the document untouched.
+	content := cache.Content
+	version := document.Version
+	contents := []*rope.Rope{content}
+	for i := range ops {
+		updated, err := utils.ApplyOperation(content, ops[i])
+		if err != nil {
+			return commit, err
+		}
+		ops[i].Deleted = utils.DeletedContent(content, ops[i])
+		content = updated
+		contents = append(contents, content)
+		version++
+		ops[i].Version = version
+	}
+
+	// The log is the source of truth, a version can only be written once so a
+	// stale owner fails here before touching anything else. Failing here can also
+	// mean a stale owner logged that version first, the cache is then behind the
+	// log under our own lease and is dropped so it is reloaded from it.
+	if err := s.db.Create(&ops).Error; err != nil {
+		s.dropActiveDocument(documentID, cache)
+		return commit, err
+	}
+
+	// Nothing is applied locally unless our lease is still the newest one. The
+	// operations are logged either way, the cache is dropped so they are replayed.
+	saved, err := s.appendOperationsFenced(documentID, ops, token)
+	if err != nil {
+		s.dropActiveDocument(documentID, cache)
+		return commit, err
+	}
+	if !saved {
+		s.dropActiveDocument(documentID, cache)
+		return commit, errLeaseLost
+	}
+
+	cache.Content = content
+	document.Version = version
+	for _, op := range ops {
+		applyBlame(cache, op)
+		applySuggestions(cache, op)
+	}
+	cache.Operations = append(cache.Operations, ops...)
+	if len(cache.Operations) > maxCachedOperations {
+		cache.Operations = cache.Operations[len(cache.Operations)-maxCachedOperations:]
 	}
 	cache.Dirty = true // We will only mark it false if we save the document to DB only !
 	cache.LastUsed = time.Now()
+	s.rememberOperation(cache, op.ID, document.Version)
 
-	s.operationCache.Store(document.ID.String(), cache)
+	commit.Operations = ops
+	commit.Version = document.Version
+	commit.Contents = contents
+	s.announceCommit(commit, originID)
 
-	s.saveDocumentToRedis(document)
+	return commit, nil
+}
 
-	return nil
+// dropActiveDocument forgets the cached document and our lease once the log is
+// ahead of the cache, the next request reloads both. The subscribers were not
+// told about what the log holds either, so they resync. The cache lock must be held.
+func (s *DocumentService) dropActiveDocument(documentID string, cache *models.OperationCache) {
+	s.ownership.forget(documentID)
+	cache.Evicted = true
+	s.operationCache.CompareAndDelete(documentID, cache)
+
+	if s.broadcaster != nil {
+		s.broadcaster.ResyncSubscribers(documentID)
+	}
 }
 
-func (s *DocumentService) operationalTransform(incoming, applied models.DocumentOperation) models.DocumentOperation {
+// announceCommit tells the local subscribers and the other instances about a commit, the cache lock must be held
+func (s *DocumentService) announceCommit(commit models.OperationCommit, originID string) {
+	if s.broadcaster != nil {
+		s.broadcaster.BroadcastCommit(commit, originID)
+	}
 
-	switch applied.OperationType {
-	case models.OperationTypeInsert:
-		len := len([]rune(applied.Content))
-		if applied.Pos <= incoming.Pos {
-			incoming.Pos += len
-		}
-	case models.OperationTypeDelete:
-		deletedLength := applied.DeleteLen
+	if err := s.publishCommit(commit, originID); err != nil {
+		log.Printf("Failed to publish commit for document %s: %v", commit.DocumentID.String(), err)
+	}
+}
 
-		if applied.Pos+deletedLength <= incoming.Pos {
-			incoming.Pos -= deletedLength
-		} else if applied.Pos < incoming.Pos && applied.Pos+deletedLength > incoming.Pos {
-			incoming.Pos = applied.Pos
+// lockActiveDocument returns the active document with its lock held, never one evicted in the meantime
+func (s *DocumentService) lockActiveDocument(documentID string) (*models.OperationCache, error) {
+	for {
+		cache, err := s.getActiveDocument(documentID)
+		if err != nil {
+			return nil, err
 		}
 
-	case models.OperationTypeReplace:
-		diff := len([]rune(applied.Content)) - applied.DeleteLen
-		if applied.Pos+applied.DeleteLen <= incoming.Pos {
-			incoming.Pos += diff
-		} else if applied.Pos < incoming.Pos && applied.Pos+applied.DeleteLen > incoming.Pos {
-			incoming.Pos = applied.Pos + len([]rune(applied.Content))
+		cache.Mu.Lock()
+		if !cache.Evicted {
+			cache.LastUsed = time.Now()
+			return cache, nil
 		}
+		cache.Mu.Unlock()
 	}
-
-	return incoming
 }
 
 func (s *DocumentService) getActiveDocument(documentID string) (*models.OperationCache, error) {
 	if document, ok := s.operationCache.Load(documentID); ok {
-		doc := document.(*models.OperationCache)
-		doc.LastUsed = time.Now()
-		return doc, nil
+		return document.(*models.OperationCache), nil
 	}
 
 	document := &models.Document{}
@@ -269,7 +536,7 @@ func (s *DocumentService) getActiveDocument(documentID string) (*models.Operatio
 	result, err := s.redis.Get(context.Background(), documentID).Result()
 
 	if err == redis.Nil {
-		dbResult := s.db.Where("id = ?", documentID).Select("id, title, content, author_id, version, created_at, updated_at").First(document)
+		dbResult := s.db.Where("id = ?", documentID).Select("id, title, content, author_id, version, parent_id, parent_version, created_at, updated_at").First(document)
 		if dbResult.Error != nil {
 			return nil, dbResult.Error
 		}
@@ -278,7 +545,7 @@ func (s *DocumentService) getActiveDocument(documentID string) (*models.Operatio
 		if err != nil {
 			return nil, err
 		}
-		s.redis.Set(context.Background(), documentID, data, 0)
+		s.redis.Set(context.Background(), documentID, data, documentRedisTTL)
 	} else if err != nil {
 		return nil, err
 	}
@@ -290,83 +557,133 @@ func (s *DocumentService) getActiveDocument(documentID string) (*models.Operatio
 		}
 	}
 
-	ad := &models.OperationCache{
-		ActiveDocument: document,
-		Operations:     []models.DocumentOperation{},
-		LastUsed:       time.Now(),
-		Dirty:          false,
+	// The snapshot only holds the last flush, the stream and the log have everything after it
+	ad := models.NewOperationCache(document)
+	if err := s.catchUp(ad); err != nil {
+		return nil, err
 	}
-
-	s.operationCache.Store(documentID, ad)
-	return ad, nil
-}
-
-func (s *DocumentService) getOperationsSince(baseVersion int, documentID uuid.UUID) []models.DocumentOperation {
-	cache, ok := s.operationCache.Load(documentID.String())
-	if !ok {
-		return nil
+	if err := s.loadSeenOperations(ad); err != nil {
+		return nil, err
 	}
-
-	doc := cache.(*models.OperationCache)
-
-	operations := []models.DocumentOperation{}
-	for _, op := range doc.Operations {
-		if op.BaseVersion > baseVersion {
-			operations = append(operations, op)
-		}
+	if err := s.loadCheckpoint(ad); err != nil {
+		return nil, err
+	}
+	if err := s.loadBlame(ad); err != nil {
+		return nil, err
+	}
+	if err := s.loadSuggestions(ad); err != nil {
+		return nil, err
 	}
 
-	return operations
-
+	// Another request may have loaded the same document meanwhile, always share one cache
+	actual, _ := s.operationCache.LoadOrStore(documentID, ad)
+	return actual.(*models.OperationCache), nil
 }
 
-func (s *DocumentService) saveDocumentToRedis(document *models.Document) error {
-	json, err := json.Marshal(document)
+// catchUpFromLog applies the logged operations the cached document is missing,
+// the cache lock must be held.
+func (s *DocumentService) catchUpFromLog(cache *models.OperationCache) error {
+	document := cache.ActiveDocument
+
+	missing := []models.DocumentOperation{}
+	err := s.db.Where("document_id = ? AND version > ?", document.ID, document.Version).Order("version ASC").Find(&missing).Error
 	if err != nil {
 		return err
 	}
-	s.redis.Set(context.Background(), document.ID.String(), json, 0)
+
+	for _, op := range missing {
+		content, err := utils.ApplyOperation(cache.Content, op)
+		if err != nil {
+			return fmt.Errorf("operation log of document %s does not replay at version %d: %w", document.ID.String(), op.Version, err)
+		}
+		cache.Content = content
+		document.Version = op.Version
+		applyBlame(cache, op)
+		applySuggestions(cache, op)
+		cache.Operations = append(cache.Operations, op)
+		s.rememberOperation(cache, op.ID, op.Version)
+	}
+	if len(cache.Operations) > maxCachedOperations {
+		cache.Operations = cache.Operations[len(cache.Operations)-maxCachedOperations:]
+	}
+	if len(missing) > 0 {
+		cache.Dirty = true
+	}
+
 	return nil
 }
 
-func (s *DocumentService) SaveDocumentsToDB() {
+// SaveDocumentsToDB flushes every dirty document and returns the IDs of the ones it could not save
+func (s *DocumentService) SaveDocumentsToDB() []string {
+	failed := []string{}
 
 	s.operationCache.Range(func(key, value any) bool {
 		cache := value.(*models.OperationCache)
 		cache.Mu.Lock()
 		defer cache.Mu.Unlock()
 
-		if !cache.Dirty {
-			return true
+		if err := s.flushDocument(cache); err != nil {
+			log.Printf("Failed to save document to DB: %s %v", cache.ActiveDocument.ID.String(), err)
+			failed = append(failed, cache.ActiveDocument.ID.String())
 		}
 
-		document := cache.ActiveDocument
+		return true
+	})
 
-		err := s.db.Model(&models.Document{}).Where("id = ?", document.ID).Updates(document).Error
-		if err != nil {
-			log.Printf("Failed to save document to DB: %s %v", document.ID.String(), err)
-			return false
-		}
+	return failed
+}
 
-		cache.Dirty = false
-		cache.LastUsed = time.Now()
+// Shutdown stops taking operations, runs a last flush, hands the document leases
+// back and leaves the live node set. The workers must be stopped first or the
+// heartbeat puts us back in the set. It returns the documents it failed to save to the DB.
+func (s *DocumentService) Shutdown(ctx context.Context) []string {
+	s.ownership.close()
+	failed := s.SaveDocumentsToDB()
 
-		return true
-	})
+	s.ownership.releaseAll(ctx)
+	if err := s.ownership.leave(ctx); err != nil {
+		log.Printf("Failed to leave the node set: %v", err)
+	}
 
+	return failed
 }
 
-func (s *DocumentService) SearchUserForDocument(query string, limit int, documentID string, userID string) ([]models.User, error) {
-	users := []models.User{}
+// flushDocument writes a dirty document to the DB and redis, the cache lock
+// must be held. This is where the text is materialized. A copy already at a
+// newer version, written by a later owner, is left alone.
+func (s *DocumentService) flushDocument(cache *models.OperationCache) error {
+	if !cache.Dirty {
+		return nil
+	}
 
-	parsedUserID := uuid.MustParse(userID)
+	document := cache.Snapshot()
 
-	document := &models.Document{}
-	s.db.Where("id = ?", documentID).First(document)
+	err := s.db.Model(&models.Document{}).
+		Where("id = ? AND version <= ?", document.ID, document.Version).
+		Updates(map[string]any{"content": document.Content, "version": document.Version}).Error
+	if err != nil {
+		return err
+	}
 
-	if document.AuthorID != parsedUserID {
-		return users, errors.New("you are not authorized to search users for this document")
+	if err := s.saveSnapshotToRedis(&document); err != nil {
+		return err
 	}
+	s.checkpointIfDue(cache, &document)
+	s.saveBlame(cache)
+	s.saveSuggestions(cache)
+
+	cache.Dirty = false
+	return nil
+}
+
+func (s *DocumentService) SearchUserForDocument(ctx context.Context, query string, limit int, documentID string, userID string) ([]models.User, error) {
+	users := []models.User{}
+
+	if err := s.checkCapability(ctx, userID, documentID, models.CapabilityShare); err != nil {
+		return users, err
+	}
+
+	parsedUserID := uuid.MustParse(userID)
 
 	userIDs := s.userSearchTrie.SearchUsers(query, limit)
 
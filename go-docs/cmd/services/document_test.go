@@ -0,0 +1,104 @@
+package services
+
+import (
+	"errors"
+	"go-docs/cmd/models"
+	"go-docs/cmd/rope"
+	"go-docs/cmd/utils"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+/*
+The operations reach the log, then streaming them fails because redis is
+down. The cache must not stay behind the log with our lease still cached,
+every later operation would then reuse a logged version.
+*/
+func TestSubmitOperationDropsCacheWhenStreamFails(t *testing.T) {
+	// The dry run insert into the log succeeds, streaming it to redis fails
+	s, broadcaster := newTestService(t)
+	cache := ownedDocument(s, "hello", 3)
+	documentID := cache.ActiveDocument.ID.String()
+
+	op := insertAt(0, 5, "!")
+	op.DocumentID = cache.ActiveDocument.ID
+	op.BaseVersion = 3
+	if _, err := s.OperationEvent(op, "", utils.PositionUnitRune); err == nil {
+		t.Fatalf("OperationEvent succeeded with redis down")
+	}
+
+	if _, ok := s.ownership.leases[documentID]; ok {
+		t.Errorf("lease still cached after the failed append")
+	}
+	if _, ok := s.operationCache.Load(documentID); ok || !cache.Evicted {
+		t.Errorf("cache still active after the failed append")
+	}
+	if cache.ActiveDocument.Version != 3 || cache.Content.String() != "hello" {
+		t.Errorf("cache at version %d with %q, want it untouched", cache.ActiveDocument.Version, cache.Content.String())
+	}
+	if len(broadcaster.resyncs) != 1 || len(broadcaster.commits) != 0 {
+		t.Errorf("resyncs = %v, commits = %d, want the subscribers resynced and no commit", broadcaster.resyncs, len(broadcaster.commits))
+	}
+}
+
+/*
+A stale owner logged the next version before we took over, our insert into the
+log hits the version it wrote. The cache was caught up under our lease already,
+it must be dropped or every later operation would hit the same version.
+*/
+func TestSubmitOperationDropsCacheWhenLogInsertFails(t *testing.T) {
+	s, broadcaster := newTestService(t)
+	duplicate := errors.New(`duplicate key value violates unique constraint "document_operations_pkey"`)
+	err := s.db.Callback().Create().Before("gorm:create").Register("test:duplicate_version", func(tx *gorm.DB) {
+		tx.AddError(duplicate)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := ownedDocument(s, "hello", 3)
+	documentID := cache.ActiveDocument.ID.String()
+
+	op := insertAt(0, 5, "!")
+	op.DocumentID = cache.ActiveDocument.ID
+	op.BaseVersion = 3
+	if _, err := s.OperationEvent(op, "", utils.PositionUnitRune); !errors.Is(err, duplicate) {
+		t.Fatalf("OperationEvent returned %v, want the failed insert", err)
+	}
+
+	if _, ok := s.ownership.leases[documentID]; ok {
+		t.Errorf("lease still cached after the failed insert")
+	}
+	if _, ok := s.operationCache.Load(documentID); ok || !cache.Evicted {
+		t.Errorf("cache still active after the failed insert")
+	}
+	if cache.ActiveDocument.Version != 3 || cache.Content.String() != "hello" {
+		t.Errorf("cache at version %d with %q, want it untouched", cache.ActiveDocument.Version, cache.Content.String())
+	}
+	if len(broadcaster.resyncs) != 1 || len(broadcaster.commits) != 0 {
+		t.Errorf("resyncs = %v, commits = %d, want the subscribers resynced and no commit", broadcaster.resyncs, len(broadcaster.commits))
+	}
+}
+
+func TestWithContentSinceHandsBackTheBaseVersion(t *testing.T) {
+	s, _ := newTestService(t)
+	cache := ownedDocument(s, "hello", 3)
+	commitTo(t, cache, insertAt(4, 0, "oh "))
+	commitTo(t, cache, insertAt(5, 8, "!"))
+
+	err := s.WithContentSince(cache.ActiveDocument.ID.String(), 3, func(base, content *rope.Rope, newerVersions []models.DocumentOperation) {
+		if base.String() != "hello" || content.String() != "oh hello!" {
+			t.Errorf("base %q and content %q, want %q and %q", base.String(), content.String(), "hello", "oh hello!")
+		}
+		if len(newerVersions) != 2 {
+			t.Errorf("got %d newer operations, want 2", len(newerVersions))
+		}
+		if pos := utils.TransformPosition(utils.TransformPosition(4, newerVersions[0]), newerVersions[1]); pos != 7 {
+			t.Errorf("position before the o of hello moved to %d, want 7", pos)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,163 @@
+package services
+
+import (
+	"context"
+	"go-docs/cmd/models"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type FlusherConfig struct {
+	Interval     time.Duration // How often dirty documents are written to the DB
+	IdleTTL      time.Duration // Active documents unused for this long are evicted
+	MemoryBudget int64         // Evict the least recently used documents above this many bytes
+}
+
+// FlusherConfigFromEnv reads FLUSH_INTERVAL, DOCUMENT_IDLE_TTL and DOCUMENT_CACHE_BUDGET_MB
+func FlusherConfigFromEnv() FlusherConfig {
+	config := FlusherConfig{
+		Interval:     30 * time.Second,
+		IdleTTL:      10 * time.Minute,
+		MemoryBudget: 256 << 20,
+	}
+
+	if interval, err := time.ParseDuration(os.Getenv("FLUSH_INTERVAL")); err == nil && interval > 0 {
+		config.Interval = interval
+	}
+	if idleTTL, err := time.ParseDuration(os.Getenv("DOCUMENT_IDLE_TTL")); err == nil && idleTTL > 0 {
+		config.IdleTTL = idleTTL
+	}
+	if budget, err := strconv.ParseInt(os.Getenv("DOCUMENT_CACHE_BUDGET_MB"), 10, 64); err == nil && budget > 0 {
+		config.MemoryBudget = budget << 20
+	}
+
+	return config
+}
+
+// RunFlusher flushes and evicts active documents until ctx is done, it is
+// restarted if it ever panics.
+func (s *DocumentService) RunFlusher(ctx context.Context, config FlusherConfig) {
+	log.Printf("Flushing documents every %s, evicting after %s idle 🧹", config.Interval, config.IdleTTL)
+
+	for {
+		s.flushLoop(ctx, config)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+			log.Println("Restarting document flusher")
+		}
+	}
+}
+
+func (s *DocumentService) flushLoop(ctx context.Context, config FlusherConfig) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Document flusher panicked: %v", r)
+		}
+	}()
+
+	ticker := time.NewTicker(config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.SaveDocumentsToDB()
+			s.evictDocuments(ctx, config)
+		}
+	}
+}
+
+type evictionCandidate struct {
+	documentID string
+	cache      *models.OperationCache
+	lastUsed   time.Time
+	size       int64
+}
+
+/*
+1. Evict every document idle for longer than the TTL
+2. If the rest is still over the memory budget, evict the least recently used
+Documents somebody is connected to are never evicted.
+*/
+func (s *DocumentService) evictDocuments(ctx context.Context, config FlusherConfig) {
+	candidates := []evictionCandidate{}
+	var total int64
+
+	s.operationCache.Range(func(key, value any) bool {
+		cache := value.(*models.OperationCache)
+
+		cache.Mu.Lock()
+		candidate := evictionCandidate{
+			documentID: key.(string),
+			cache:      cache,
+			lastUsed:   cache.LastUsed,
+			size:       cacheSize(cache),
+		}
+		cache.Mu.Unlock()
+
+		total += candidate.size
+		if !s.hasSubscribers(candidate.documentID) {
+			candidates = append(candidates, candidate)
+		}
+		return true
+	})
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastUsed.Before(candidates[j].lastUsed)
+	})
+
+	for _, candidate := range candidates {
+		idle := time.Since(candidate.lastUsed) > config.IdleTTL
+		if !idle && total <= config.MemoryBudget {
+			break
+		}
+
+		if s.evictDocument(ctx, candidate.documentID, candidate.cache) {
+			total -= candidate.size
+		}
+	}
+}
+
+// evictDocument drops an active document once its changes are in the DB
+func (s *DocumentService) evictDocument(ctx context.Context, documentID string, cache *models.OperationCache) bool {
+	cache.Mu.Lock()
+	if err := s.flushDocument(cache); err != nil {
+		cache.Mu.Unlock()
+		log.Printf("Not evicting document %s, failed to save it to DB: %v", documentID, err)
+		return false
+	}
+
+	cache.Evicted = true
+	s.operationCache.CompareAndDelete(documentID, cache)
+	cache.Mu.Unlock()
+
+	s.ownership.release(ctx, documentID)
+	return true
+}
+
+func (s *DocumentService) hasSubscribers(documentID string) bool {
+	return s.broadcaster != nil && s.broadcaster.Subscribers(documentID) > 0
+}
+
+// cacheSize roughly estimates the memory held by an active document
+func cacheSize(cache *models.OperationCache) int64 {
+	const operationOverhead = 160
+	const seenOverhead = 48
+
+	// The rope keeps every rune on 4 bytes
+	size := int64(cache.Content.Len()*4 + len(cache.ActiveDocument.Title))
+	for _, op := range cache.Operations {
+		size += int64(len(op.Content) + operationOverhead)
+	}
+	size += int64(len(cache.SeenOrder) * seenOverhead)
+
+	return size
+}
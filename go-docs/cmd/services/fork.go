@@ -0,0 +1,127 @@
+package services
+
+import (
+	"context"
+	"go-docs/cmd/models"
+	"go-docs/cmd/server/dto"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+/*
+ForkDocument copies a document the user can read into a new one they own:
+1. Take the live content, or rebuild the requested version
+2. Create the fork pointing back at its parent and the version it came from
+3. With history, it keeps the parent versions: the operation log, checkpoints
+and named versions up to the fork are copied and the fork goes on from there.
+Without, it starts over at version 0 like a new document.
+4. With collaborators, everybody the parent is shared with gets the same access.
+Only a user who can see who the parent is shared with may copy that list.
+*/
+func (s *DocumentService) ForkDocument(ctx context.Context, userID, documentID string, request dto.ForkDocumentRequest) (string, error) {
+	role, err := s.policy.Role(ctx, userID, documentID)
+	if err != nil {
+		return "", err
+	}
+	if err := RequireCapability(role, models.CapabilityExport); err != nil {
+		return "", err
+	}
+	if request.Collaborators {
+		if err := RequireCapability(role, models.CapabilityShare); err != nil {
+			return "", err
+		}
+	}
+
+	cache, err := s.lockActiveDocument(documentID)
+	if err != nil {
+		return "", err
+	}
+	parent := cache.ActiveDocument
+	parentID, title, version, content := parent.ID, parent.Title, parent.Version, cache.Content
+	cache.Mu.Unlock()
+
+	if request.Version != nil && *request.Version != version {
+		version = *request.Version
+		if content, _, err = s.contentAt(documentID, version); err != nil {
+			return "", err
+		}
+	}
+
+	if request.Title != "" {
+		title = request.Title
+	} else {
+		title = "Copy of " + title
+	}
+
+	fork := &models.Document{
+		Title:         title,
+		Content:       content.String(),
+		AuthorID:      uuid.MustParse(userID),
+		ParentID:      &parentID,
+		ParentVersion: &version,
+	}
+	if request.History {
+		fork.Version = version
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(fork).Error; err != nil {
+			return err
+		}
+
+		if request.History {
+			if err := copyHistory(tx, parentID, fork.ID, version); err != nil {
+				return err
+			}
+		}
+
+		// History of the fork starts here, or goes on from here
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.DocumentCheckpoint{
+			DocumentID: fork.ID,
+			Version:    fork.Version,
+			Content:    fork.Content,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		if request.Collaborators {
+			err := tx.Exec(`INSERT INTO document_collaborators (document_id, user_id, access, created_at, updated_at)
+				SELECT ?, user_id, access, NOW(), NOW() FROM document_collaborators
+				WHERE document_id = ? AND user_id <> ?`, fork.ID, parentID, fork.AuthorID).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return fork.ID.String(), nil
+}
+
+// copyHistory copies what is needed to rebuild every version up to version from one document to another
+func copyHistory(tx *gorm.DB, fromID, toID uuid.UUID, version int) error {
+	err := tx.Exec(`INSERT INTO document_operations (id, document_id, user_id, operation_type, content, pos, delete_len, deleted, base_version, version, timestamp)
+		SELECT id, ?, user_id, operation_type, content, pos, delete_len, deleted, base_version, version, timestamp FROM document_operations
+		WHERE document_id = ? AND version <= ?`, toID, fromID, version).Error
+	if err != nil {
+		return err
+	}
+
+	err = tx.Exec(`INSERT INTO document_checkpoints (document_id, version, content, created_at)
+		SELECT ?, version, content, created_at FROM document_checkpoints
+		WHERE document_id = ? AND version <= ?`, toID, fromID, version).Error
+	if err != nil {
+		return err
+	}
+
+	return tx.Exec(`INSERT INTO document_snapshots (document_id, name, description, version, content, created_by_id, created_at, updated_at)
+		SELECT ?, name, description, version, content, created_by_id, created_at, NOW() FROM document_snapshots
+		WHERE document_id = ? AND version <= ?`, toID, fromID, version).Error
+}
@@ -0,0 +1,252 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"go-docs/cmd/models"
+	"go-docs/cmd/rope"
+	"go-docs/cmd/server/dto"
+	"go-docs/cmd/utils"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	checkpointInterval = 100             // Versions between two checkpoints, the most a version rebuild replays
+	revisionGap        = 5 * time.Minute // Operations further apart start a new revision
+	maxHistoryPageSize = 100
+)
+
+var ErrVersionNotFound = errors.New("this version does not exist or is older than the document history")
+
+/*
+A revision is a run of consecutive operations by the same author, each one
+less than revisionGap after the previous. The operation log is numbered into
+revisions with window functions, newest first.
+*/
+const revisionsQuery = `
+WITH marked AS (
+	SELECT version, user_id, timestamp,
+		CASE WHEN user_id = LAG(user_id) OVER w AND timestamp - LAG(timestamp) OVER w < ? * INTERVAL '1 second'
+			THEN 0 ELSE 1 END AS starts_revision
+	FROM document_operations
+	WHERE document_id = ?
+	WINDOW w AS (ORDER BY version)
+), numbered AS (
+	SELECT *, SUM(starts_revision) OVER (ORDER BY version) AS revision FROM marked
+)
+SELECT MIN(version) AS from_version, MAX(version) AS version, user_id,
+	MIN(timestamp) AS started_at, MAX(timestamp) AS ended_at, COUNT(*) AS operation_count
+FROM numbered
+GROUP BY revision, user_id`
+
+// GetHistory lists the revisions of a document, page starts at 1
+func (s *DocumentService) GetHistory(ctx context.Context, userID, documentID string, page, limit int) (*dto.HistoryResponse, error) {
+	if err := s.checkCapability(ctx, userID, documentID, models.CapabilityView); err != nil {
+		return nil, err
+	}
+
+	page = max(page, 1)
+	limit = min(max(limit, 1), maxHistoryPageSize)
+	gap := revisionGap.Seconds()
+
+	type revisionRow struct {
+		FromVersion    int
+		Version        int
+		UserID         uuid.UUID
+		StartedAt      time.Time
+		EndedAt        time.Time
+		OperationCount int
+	}
+
+	rows := []revisionRow{}
+	err := s.db.Raw(revisionsQuery+" ORDER BY version DESC LIMIT ? OFFSET ?", gap, documentID, limit, (page-1)*limit).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var total int64
+	if err := s.db.Raw("SELECT COUNT(*) FROM ("+revisionsQuery+") revisions", gap, documentID).Scan(&total).Error; err != nil {
+		return nil, err
+	}
+
+	authorIDs := []uuid.UUID{}
+	for _, row := range rows {
+		authorIDs = append(authorIDs, row.UserID)
+	}
+	authors := []models.User{}
+	if err := s.db.Where("id IN ?", authorIDs).Find(&authors).Error; err != nil {
+		return nil, err
+	}
+	authorsByID := make(map[uuid.UUID]models.User, len(authors))
+	for _, author := range authors {
+		authorsByID[author.ID] = author
+	}
+
+	snapshots := []models.DocumentSnapshot{}
+	if len(rows) > 0 {
+		// Rows are newest first
+		if snapshots, err = s.snapshotsBetween(documentID, rows[len(rows)-1].FromVersion, rows[0].Version); err != nil {
+			return nil, err
+		}
+	}
+
+	history := &dto.HistoryResponse{Revisions: []dto.Revision{}, Page: page, Limit: limit, Total: total}
+	for _, row := range rows {
+		revision := dto.Revision{
+			FromVersion:    row.FromVersion,
+			Version:        row.Version,
+			Author:         authorsByID[row.UserID],
+			StartedAt:      row.StartedAt,
+			EndedAt:        row.EndedAt,
+			OperationCount: row.OperationCount,
+			Snapshots:      []models.DocumentSnapshot{},
+		}
+		for _, snapshot := range snapshots {
+			if snapshot.Version >= row.FromVersion && snapshot.Version <= row.Version {
+				revision.Snapshots = append(revision.Snapshots, snapshot)
+			}
+		}
+		history.Revisions = append(history.Revisions, revision)
+	}
+
+	return history, nil
+}
+
+/*
+GetVersion rebuilds the document content right after version was committed:
+1. Start from the newest checkpoint at or before version
+2. Replay the logged operations up to version on top of it
+*/
+func (s *DocumentService) GetVersion(ctx context.Context, userID, documentID string, version int) (*dto.DocumentVersionResponse, error) {
+	if err := s.checkCapability(ctx, userID, documentID, models.CapabilityView); err != nil {
+		return nil, err
+	}
+
+	content, timestamp, err := s.contentAt(documentID, version)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dto.DocumentVersionResponse{
+		DocumentID: documentID,
+		Version:    version,
+		Content:    content.String(),
+		Timestamp:  timestamp,
+	}, nil
+}
+
+// DiffContents rebuilds the contents to diff between versions from and to, a
+// negative to stands for the live document. It returns the version to resolved to.
+func (s *DocumentService) DiffContents(ctx context.Context, userID, documentID string, from, to int) (string, string, int, error) {
+	if err := s.checkCapability(ctx, userID, documentID, models.CapabilityView); err != nil {
+		return "", "", 0, err
+	}
+
+	var toContent *rope.Rope
+	if to < 0 {
+		cache, err := s.lockActiveDocument(documentID)
+		if err != nil {
+			return "", "", 0, err
+		}
+		toContent, to = cache.Content, cache.ActiveDocument.Version
+		cache.Mu.Unlock()
+	} else {
+		content, _, err := s.contentAt(documentID, to)
+		if err != nil {
+			return "", "", 0, err
+		}
+		toContent = content
+	}
+
+	fromContent, _, err := s.contentAt(documentID, from)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	return fromContent.String(), toContent.String(), to, nil
+}
+
+// contentAt rebuilds the content at version and tells when that version was committed
+func (s *DocumentService) contentAt(documentID string, version int) (*rope.Rope, time.Time, error) {
+	checkpoint := models.DocumentCheckpoint{}
+	err := s.db.Where("document_id = ? AND version <= ?", documentID, version).Order("version DESC").First(&checkpoint).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, time.Time{}, ErrVersionNotFound
+	} else if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	ops := []models.DocumentOperation{}
+	err = s.db.Where("document_id = ? AND version > ? AND version <= ?", documentID, checkpoint.Version, version).
+		Order("version ASC").
+		Find(&ops).Error
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if len(ops) != version-checkpoint.Version {
+		// Not committed yet
+		return nil, time.Time{}, ErrVersionNotFound
+	}
+
+	content := rope.New(checkpoint.Content)
+	timestamp := checkpoint.CreatedAt
+	for _, op := range ops {
+		if content, err = utils.ApplyOperation(content, op); err != nil {
+			return nil, time.Time{}, err
+		}
+		timestamp = op.Timestamp
+	}
+
+	return content, timestamp, nil
+}
+
+// saveCheckpoint stores the content at version, a checkpoint already there is kept
+func (s *DocumentService) saveCheckpoint(documentID uuid.UUID, version int, content string) error {
+	return s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.DocumentCheckpoint{
+		DocumentID: documentID,
+		Version:    version,
+		Content:    content,
+	}).Error
+}
+
+// checkpointIfDue writes a checkpoint when the document moved far enough since the last one, the cache lock must be held
+func (s *DocumentService) checkpointIfDue(cache *models.OperationCache, document *models.Document) {
+	if document.Version < cache.Checkpoint+checkpointInterval {
+		return
+	}
+
+	if err := s.saveCheckpoint(document.ID, document.Version, document.Content); err != nil {
+		log.Printf("Failed to checkpoint document %s at version %d: %v", document.ID.String(), document.Version, err)
+		return
+	}
+	cache.Checkpoint = document.Version
+}
+
+// loadCheckpoint finds the newest checkpoint of a freshly loaded document. Documents
+// from before checkpoints existed get their first one, their history starts there.
+func (s *DocumentService) loadCheckpoint(cache *models.OperationCache) error {
+	document := cache.ActiveDocument
+
+	var newest *int
+	err := s.db.Model(&models.DocumentCheckpoint{}).Select("MAX(version)").Where("document_id = ?", document.ID).Scan(&newest).Error
+	if err != nil {
+		return err
+	}
+
+	if newest != nil {
+		cache.Checkpoint = *newest
+		return nil
+	}
+
+	if err := s.saveCheckpoint(document.ID, document.Version, cache.Content.String()); err != nil {
+		return err
+	}
+	cache.Checkpoint = document.Version
+	return nil
+}
@@ -0,0 +1,57 @@
+package services
+
+import (
+	"go-docs/cmd/models"
+
+	"github.com/google/uuid"
+)
+
+// How many committed operation IDs an active document remembers, more than the
+// operations it keeps since anything older needs a resync anyway
+const maxSeenOperations = 1000
+
+// rememberOperation records the version an operation ID committed at, the cache lock must be held
+func (s *DocumentService) rememberOperation(cache *models.OperationCache, operationID uuid.UUID, version int) {
+	if cache.Seen == nil {
+		cache.Seen = make(map[uuid.UUID]int)
+	}
+
+	if _, ok := cache.Seen[operationID]; !ok {
+		cache.SeenOrder = append(cache.SeenOrder, operationID)
+	}
+	cache.Seen[operationID] = version
+
+	for len(cache.SeenOrder) > maxSeenOperations {
+		delete(cache.Seen, cache.SeenOrder[0])
+		cache.SeenOrder = cache.SeenOrder[1:]
+	}
+}
+
+// loadSeenOperations rebuilds the seen set from the operation log, so a
+// restart or a new owner still recognises operations sent again.
+func (s *DocumentService) loadSeenOperations(cache *models.OperationCache) error {
+	type committed struct {
+		ID      uuid.UUID
+		Version int
+	}
+
+	rows := []committed{}
+	err := s.db.Model(&models.DocumentOperation{}).
+		Select("id, MAX(version) AS version").
+		Where("document_id = ?", cache.ActiveDocument.ID).
+		Group("id").
+		Order("version DESC").
+		Limit(maxSeenOperations).
+		Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+
+	cache.Seen = make(map[uuid.UUID]int, len(rows))
+	cache.SeenOrder = make([]uuid.UUID, 0, len(rows))
+	for i := len(rows) - 1; i >= 0; i-- {
+		s.rememberOperation(cache, rows[i].ID, rows[i].Version)
+	}
+
+	return nil
+}
@@ -0,0 +1,442 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"go-docs/cmd/models"
+	"go-docs/cmd/utils"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/dgryski/go-rendezvous"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+Every document has a single writer node at a time:
+1. Live nodes heartbeat into a sorted set, the document ID is hashed over
+that set (rendezvous hashing) to pick the preferred owner
+2. The preferred owner takes a redis lease on the document, each new lease
+increments a fencing token
+3. Redis writes carry the token and are rejected once a newer lease exists
+4. Other nodes forward their operations to the lease holder
+When a node dies its heartbeat and leases expire and the next operation
+elects a new owner among the remaining nodes.
+*/
+
+const (
+	nodesKey          = "go-docs:nodes"
+	heartbeatInterval = 2 * time.Second
+	nodeTTL           = 3 * heartbeatInterval
+	leaseTTL          = 10 * time.Second
+	forwardTimeout    = 5 * time.Second
+)
+
+var (
+	errNotDocumentOwner = errors.New("this node does not own the document, retry the operation")
+	errLeaseLost        = errors.New("document lease was lost, retry the operation")
+	errNodeShuttingDown = errors.New("this node is shutting down, retry the operation")
+)
+
+// Returns {holder node, fencing token}. Takes the lease only if nobody holds it.
+var acquireLeaseScript = redis.NewScript(`
+local owner = redis.call('GET', KEYS[1])
+if owner then
+	local node, token = string.match(owner, '^(.*):(%d+)$')
+	if node == ARGV[1] then
+		redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	end
+	return {node, token}
+end
+local token = redis.call('INCR', KEYS[2])
+redis.call('SET', KEYS[1], ARGV[1] .. ':' .. token, 'PX', ARGV[2])
+return {ARGV[1], tostring(token)}
+`)
+
+var renewLeaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+var releaseLeaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+type lease struct {
+	token     int64
+	expiresAt time.Time
+}
+
+type forwardedOperation struct {
+	RequestID string                   `json:"request_id"`
+	ReplyTo   string                   `json:"reply_to"`
+	OriginID  string                   `json:"origin_id"`
+	Unit      utils.PositionUnit       `json:"unit"`
+	Operation models.DocumentOperation `json:"operation"`
+	Suggest   bool                     `json:"suggest,omitempty"` // Record it as a suggestion instead of applying it
+}
+
+type forwardedReply struct {
+	RequestID  string                       `json:"request_id"`
+	Commit     models.OperationCommit       `json:"commit"`
+	Suggestion *models.DocumentSuggestion   `json:"suggestion,omitempty"`
+	Error      string                       `json:"error,omitempty"`
+	Resync     *ResyncRequiredError         `json:"resync,omitempty"`
+	Invalid    *utils.InvalidOperationError `json:"invalid,omitempty"`
+}
+
+// Messages addressed to a single node
+type nodeMessage struct {
+	Forward *forwardedOperation `json:"forward,omitempty"`
+	Reply   *forwardedReply     `json:"reply,omitempty"`
+}
+
+type documentOwnership struct {
+	redis   *redis.Client
+	nodeID  string
+	mu      sync.Mutex
+	leases  map[string]lease
+	pending map[string]chan forwardedReply
+	closed  bool // Shutting down, no lease is taken or used anymore
+}
+
+func newDocumentOwnership(redis *redis.Client, nodeID string) *documentOwnership {
+	return &documentOwnership{
+		redis:   redis,
+		nodeID:  nodeID,
+		leases:  make(map[string]lease),
+		pending: make(map[string]chan forwardedReply),
+	}
+}
+
+func ownerKey(documentID string) string {
+	return "document:" + documentID + ":owner"
+}
+
+func fenceKey(documentID string) string {
+	return "document:" + documentID + ":fence"
+}
+
+func nodeChannel(nodeID string) string {
+	return "node:" + nodeID
+}
+
+func (o *documentOwnership) heartbeat(ctx context.Context) error {
+	now := time.Now()
+	pipe := o.redis.TxPipeline()
+	pipe.ZAdd(ctx, nodesKey, redis.Z{Score: float64(now.UnixMilli()), Member: o.nodeID})
+	pipe.ZRemRangeByScore(ctx, nodesKey, "-inf", strconv.FormatInt(now.Add(-nodeTTL).UnixMilli(), 10))
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (o *documentOwnership) liveNodes(ctx context.Context) ([]string, error) {
+	nodes, err := o.redis.ZRangeByScore(ctx, nodesKey, &redis.ZRangeBy{
+		Min: strconv.FormatInt(time.Now().Add(-nodeTTL).UnixMilli(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, node := range nodes {
+		if node == o.nodeID {
+			return nodes, nil
+		}
+	}
+	return append(nodes, o.nodeID), nil
+}
+
+func (o *documentOwnership) preferredOwner(ctx context.Context, documentID string) (string, error) {
+	nodes, err := o.liveNodes(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return rendezvous.New(nodes, xxhash.Sum64String).Lookup(documentID), nil
+}
+
+/*
+claim returns the node that must apply operations for the document. When that
+is us it also returns our fencing token, the caller compares it with the token
+its copy of the document was caught up under to know whether it may be stale.
+*/
+func (o *documentOwnership) claim(ctx context.Context, documentID string) (owner string, token int64, err error) {
+	o.mu.Lock()
+	held, ok := o.leases[documentID]
+	closed := o.closed
+	o.mu.Unlock()
+	if closed {
+		return "", 0, errNodeShuttingDown
+	}
+	if ok && time.Now().Before(held.expiresAt) {
+		return o.nodeID, held.token, nil
+	}
+
+	current, err := o.redis.Get(ctx, ownerKey(documentID)).Result()
+	if err != nil && err != redis.Nil {
+		return "", 0, err
+	}
+
+	if err == redis.Nil {
+		preferred, err := o.preferredOwner(ctx, documentID)
+		if err != nil {
+			return "", 0, err
+		}
+		if preferred != o.nodeID {
+			return preferred, 0, nil
+		}
+	} else if node, _ := parseLease(current); node != o.nodeID {
+		return node, 0, nil
+	}
+
+	result, err := acquireLeaseScript.Run(ctx, o.redis, []string{ownerKey(documentID), fenceKey(documentID)}, o.nodeID, leaseTTL.Milliseconds()).StringSlice()
+	if err != nil {
+		return "", 0, err
+	}
+
+	node := result[0]
+	if node != o.nodeID {
+		return node, 0, nil
+	}
+
+	token, err = strconv.ParseInt(result[1], 10, 64)
+	if err != nil {
+		return "", 0, err
+	}
+
+	o.mu.Lock()
+	if o.closed {
+		// Shut down while we were taking it, nobody would let go of it
+		o.mu.Unlock()
+		value := o.nodeID + ":" + strconv.FormatInt(token, 10)
+		if err := releaseLeaseScript.Run(ctx, o.redis, []string{ownerKey(documentID)}, value).Err(); err != nil {
+			log.Printf("Failed to release the lease on document %s: %v", documentID, err)
+		}
+		return "", 0, errNodeShuttingDown
+	}
+	o.leases[documentID] = lease{token: token, expiresAt: time.Now().Add(leaseTTL / 2)}
+	o.mu.Unlock()
+
+	return o.nodeID, token, nil
+}
+
+// renew extends every lease for a document that is still active here and lets go of the rest
+func (o *documentOwnership) renew(ctx context.Context, active func(documentID string) bool) {
+	o.mu.Lock()
+	leases := make(map[string]lease, len(o.leases))
+	for documentID, held := range o.leases {
+		leases[documentID] = held
+	}
+	o.mu.Unlock()
+
+	for documentID, held := range leases {
+		value := o.nodeID + ":" + strconv.FormatInt(held.token, 10)
+
+		if !active(documentID) {
+			o.release(ctx, documentID)
+			continue
+		}
+
+		renewed, err := renewLeaseScript.Run(ctx, o.redis, []string{ownerKey(documentID)}, value, leaseTTL.Milliseconds()).Int()
+		o.mu.Lock()
+		if err != nil || renewed == 0 {
+			log.Printf("Lost the lease on document %s", documentID)
+			delete(o.leases, documentID)
+		} else {
+			o.leases[documentID] = lease{token: held.token, expiresAt: time.Now().Add(leaseTTL / 2)}
+		}
+		o.mu.Unlock()
+	}
+}
+
+func (o *documentOwnership) release(ctx context.Context, documentID string) {
+	o.mu.Lock()
+	held, ok := o.leases[documentID]
+	delete(o.leases, documentID)
+	o.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	value := o.nodeID + ":" + strconv.FormatInt(held.token, 10)
+	if err := releaseLeaseScript.Run(ctx, o.redis, []string{ownerKey(documentID)}, value).Err(); err != nil {
+		log.Printf("Failed to release the lease on document %s: %v", documentID, err)
+	}
+}
+
+// close stops taking leases and using the ones we hold, before they are released for good
+func (o *documentOwnership) close() {
+	o.mu.Lock()
+	o.closed = true
+	o.mu.Unlock()
+}
+
+func (o *documentOwnership) releaseAll(ctx context.Context) {
+	o.mu.Lock()
+	documentIDs := make([]string, 0, len(o.leases))
+	for documentID := range o.leases {
+		documentIDs = append(documentIDs, documentID)
+	}
+	o.mu.Unlock()
+
+	for _, documentID := range documentIDs {
+		o.release(ctx, documentID)
+	}
+}
+
+// leave removes us from the live nodes so documents are rehashed right away
+func (o *documentOwnership) leave(ctx context.Context) error {
+	return o.redis.ZRem(ctx, nodesKey, o.nodeID).Err()
+}
+
+// forget drops a lease locally, used once a fenced write tells us it is gone
+func (o *documentOwnership) forget(documentID string) {
+	o.mu.Lock()
+	delete(o.leases, documentID)
+	o.mu.Unlock()
+}
+
+// forward hands an operation to the owner of its document and waits for the answer
+func (o *documentOwnership) forward(ctx context.Context, owner string, forwarded forwardedOperation) (forwardedReply, error) {
+	forwarded.RequestID = uuid.NewString()
+	forwarded.ReplyTo = o.nodeID
+	reply := make(chan forwardedReply, 1)
+
+	o.mu.Lock()
+	o.pending[forwarded.RequestID] = reply
+	o.mu.Unlock()
+
+	defer func() {
+		o.mu.Lock()
+		delete(o.pending, forwarded.RequestID)
+		o.mu.Unlock()
+	}()
+
+	data, err := json.Marshal(nodeMessage{Forward: &forwarded})
+	if err != nil {
+		return forwardedReply{}, err
+	}
+
+	if err := o.redis.Publish(ctx, nodeChannel(owner), data).Err(); err != nil {
+		return forwardedReply{}, err
+	}
+
+	select {
+	case result := <-reply:
+		if result.Resync != nil {
+			return result, result.Resync
+		}
+		if result.Invalid != nil {
+			return result, result.Invalid
+		}
+		if result.Error != "" {
+			return result, errors.New(result.Error)
+		}
+		return result, nil
+	case <-time.After(forwardTimeout):
+		return forwardedReply{}, errors.New("document owner did not answer in time, retry the operation")
+	}
+}
+
+func (o *documentOwnership) resolve(result forwardedReply) {
+	o.mu.Lock()
+	reply, ok := o.pending[result.RequestID]
+	o.mu.Unlock()
+
+	if ok {
+		reply <- result
+	}
+}
+
+func (o *documentOwnership) reply(ctx context.Context, nodeID string, result forwardedReply) {
+	data, err := json.Marshal(nodeMessage{Reply: &result})
+	if err != nil {
+		log.Printf("Failed to encode forwarded reply: %v", err)
+		return
+	}
+
+	if err := o.redis.Publish(ctx, nodeChannel(nodeID), data).Err(); err != nil {
+		log.Printf("Failed to reply to node %s: %v", nodeID, err)
+	}
+}
+
+func parseLease(value string) (string, int64) {
+	index := strings.LastIndex(value, ":")
+	if index < 0 {
+		return value, 0
+	}
+
+	token, _ := strconv.ParseInt(value[index+1:], 10, 64)
+	return value[:index], token
+}
+
+// MaintainOwnership keeps this node in the live set and renews its leases until ctx is done
+func (s *DocumentService) MaintainOwnership(ctx context.Context) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.ownership.heartbeat(ctx); err != nil {
+			log.Printf("Failed to send node heartbeat: %v", err)
+		}
+
+		s.ownership.renew(ctx, func(documentID string) bool {
+			_, ok := s.operationCache.Load(documentID)
+			return ok
+		})
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *DocumentService) handleNodeMessage(msg nodeMessage) {
+	if msg.Reply != nil {
+		s.ownership.resolve(*msg.Reply)
+		return
+	}
+
+	if msg.Forward == nil {
+		return
+	}
+
+	forwarded := *msg.Forward
+	go func() {
+		result := forwardedReply{RequestID: forwarded.RequestID}
+
+		var err error
+		if forwarded.Suggest {
+			result.Suggestion, err = s.submitSuggestion(forwarded.Operation, forwarded.Unit, false)
+		} else {
+			result.Commit, err = s.submitOperation(forwarded.Operation, forwarded.OriginID, forwarded.Unit, false)
+		}
+
+		var resync *ResyncRequiredError
+		var invalid *utils.InvalidOperationError
+		if errors.As(err, &resync) {
+			result.Resync = resync
+		} else if errors.As(err, &invalid) {
+			result.Invalid = invalid
+		} else if err != nil {
+			result.Error = err.Error()
+		}
+
+		s.ownership.reply(context.Background(), forwarded.ReplyTo, result)
+	}()
+}
@@ -0,0 +1,229 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"go-docs/cmd/models"
+	"go-docs/cmd/rope"
+	"go-docs/cmd/utils"
+	"log"
+	"time"
+)
+
+const operationChannelPattern = "document:*:operations"
+
+// Commits travel between go-docs instances wrapped in this message, so do
+// suggestions when they are made or resolved and access changes
+type relayedCommit struct {
+	NodeID     string                     `json:"node_id"`
+	OriginID   string                     `json:"origin_id"`
+	Commit     models.OperationCommit     `json:"commit"`
+	Suggestion *models.DocumentSuggestion `json:"suggestion,omitempty"`
+	Access     *models.AccessChange       `json:"access,omitempty"`
+}
+
+func operationChannel(documentID string) string {
+	return "document:" + documentID + ":operations"
+}
+
+// publishCommit must be called with the document lock held, so the other
+// instances receive operations in version order.
+func (s *DocumentService) publishCommit(commit models.OperationCommit, originID string) error {
+	data, err := json.Marshal(relayedCommit{NodeID: s.nodeID, OriginID: originID, Commit: commit})
+	if err != nil {
+		return err
+	}
+
+	return s.redis.Publish(context.Background(), operationChannel(commit.DocumentID.String()), data).Err()
+}
+
+/*
+RelayOperations listens for operations applied by the other instances until
+ctx is done:
+1. Ignore our own commits, they are already applied and broadcasted
+2. Apply the operations to the local OperationCache if the document is active here
+3. Broadcast the commit to the local socket subscribers
+It also serves the messages addressed to this node, operations forwarded to us
+as the document owner and the replies to the ones we forwarded.
+*/
+func (s *DocumentService) RelayOperations(ctx context.Context) {
+	pubsub := s.redis.PSubscribe(ctx, operationChannelPattern)
+	defer pubsub.Close()
+
+	if err := pubsub.Subscribe(ctx, nodeChannel(s.nodeID)); err != nil {
+		log.Printf("Failed to subscribe to node channel: %v", err)
+		return
+	}
+
+	log.Println("Relaying document operations between instances 📡")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-pubsub.Channel():
+			if !ok {
+				return
+			}
+
+			if msg.Channel == nodeChannel(s.nodeID) {
+				nodeMsg := nodeMessage{}
+				if err := json.Unmarshal([]byte(msg.Payload), &nodeMsg); err != nil {
+					log.Printf("Failed to decode node message: %v", err)
+					continue
+				}
+
+				s.handleNodeMessage(nodeMsg)
+				continue
+			}
+
+			relayed := relayedCommit{}
+			if err := json.Unmarshal([]byte(msg.Payload), &relayed); err != nil {
+				log.Printf("Failed to decode relayed commit on %s: %v", msg.Channel, err)
+				continue
+			}
+
+			if relayed.NodeID == s.nodeID {
+				continue
+			}
+
+			if relayed.Suggestion != nil {
+				s.applyRelayedSuggestion(*relayed.Suggestion)
+				continue
+			}
+			if relayed.Access != nil {
+				if s.broadcaster != nil {
+					s.broadcaster.BroadcastAccess(*relayed.Access)
+				}
+				continue
+			}
+			s.applyRelayedCommit(relayed.Commit, relayed.OriginID)
+		}
+	}
+}
+
+func (s *DocumentService) applyRelayedCommit(commit models.OperationCommit, originID string) {
+	var cache *models.OperationCache
+	for {
+		value, ok := s.operationCache.Load(commit.DocumentID.String())
+		if !ok {
+			// Nobody here has the document open, it will be loaded when needed
+			return
+		}
+
+		cache = value.(*models.OperationCache)
+		cache.Mu.Lock()
+		if !cache.Evicted {
+			break
+		}
+		cache.Mu.Unlock()
+	}
+	defer cache.Mu.Unlock()
+
+	document := cache.ActiveDocument
+	before, start := document.Version, cache.Content
+
+	for _, op := range commit.Operations {
+		if op.Version <= document.Version {
+			// Already seen
+			continue
+		}
+
+		content, err := utils.ApplyOperation(cache.Content, op)
+		if op.Version != document.Version+1 || err != nil {
+			// We missed some operations, the publisher streamed them before publishing
+			if err := s.catchUp(cache); err != nil {
+				log.Printf("Failed to catch up document %s: %v", document.ID.String(), err)
+			}
+			if err := s.loadSeenOperations(cache); err != nil {
+				log.Printf("Failed to load committed operations for document %s: %v", document.ID.String(), err)
+			}
+			break
+		}
+
+		cache.Content = content
+		document.Version = op.Version
+		applyBlame(cache, op)
+		applySuggestions(cache, op)
+		cache.Operations = append(cache.Operations, op)
+	}
+	if len(cache.Operations) > maxCachedOperations {
+		cache.Operations = cache.Operations[len(cache.Operations)-maxCachedOperations:]
+	}
+
+	if !commit.Duplicate {
+		s.rememberOperation(cache, commit.OperationID, commit.Version)
+	}
+	cache.LastUsed = time.Now()
+
+	if s.broadcaster != nil {
+		s.broadcastRelayed(cache, commit, originID, before, start)
+	}
+}
+
+/*
+broadcastRelayed hands the local subscribers every operation applied since
+version before, start being the content at that version. That is the relayed
+commit, plus whatever a gap made us catch up on:
+1. The operations of the commit go out as the commit, so its origin gets the ack
+2. The others go out around it in version order, with no origin
+3. A commit that was already applied is only acked, like a duplicate
+When the operations are no longer all cached the subscribers are closed and resync.
+*/
+func (s *DocumentService) broadcastRelayed(cache *models.OperationCache, commit models.OperationCommit, originID string, before int, start *rope.Rope) {
+	document := cache.ActiveDocument
+
+	inCommit := map[int]bool{}
+	for _, op := range commit.Operations {
+		if op.Version > before {
+			inCommit[op.Version] = true
+		}
+	}
+
+	missed := []models.DocumentOperation{}
+	for _, op := range cache.Operations {
+		if op.Version > before {
+			missed = append(missed, op)
+		}
+	}
+	if len(missed) != document.Version-before {
+		s.broadcaster.ResyncSubscribers(document.ID.String())
+		return
+	}
+
+	// The subscribers counting in another unit than runes need the content around every operation
+	acked := false
+	content := start
+	for i := 0; i < len(missed); {
+		fromCommit := inCommit[missed[i].Version]
+		group := models.OperationCommit{DocumentID: commit.DocumentID, Contents: []*rope.Rope{content}}
+		for ; i < len(missed) && inCommit[missed[i].Version] == fromCommit; i++ {
+			next, err := utils.ApplyOperation(content, missed[i])
+			if err != nil {
+				s.broadcaster.ResyncSubscribers(document.ID.String())
+				return
+			}
+			content = next
+			group.Operations = append(group.Operations, missed[i])
+			group.Contents = append(group.Contents, content)
+			group.Version = missed[i].Version
+		}
+
+		groupOrigin := ""
+		if fromCommit {
+			group.OperationID = commit.OperationID
+			groupOrigin = originID
+			acked = true
+		}
+		s.broadcaster.BroadcastCommit(group, groupOrigin)
+	}
+
+	if !acked {
+		s.broadcaster.BroadcastCommit(models.OperationCommit{
+			DocumentID:  commit.DocumentID,
+			OperationID: commit.OperationID,
+			Version:     commit.Version,
+			Duplicate:   true,
+		}, originID)
+	}
+}
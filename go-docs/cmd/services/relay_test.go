@@ -0,0 +1,168 @@
+package services
+
+import (
+	"go-docs/cmd/models"
+	"go-docs/cmd/rope"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+type broadcastedCommit struct {
+	commit   models.OperationCommit
+	originID string
+}
+
+// recordingBroadcaster keeps what the service hands to the hub
+type recordingBroadcaster struct {
+	commits     []broadcastedCommit
+	suggestions []models.DocumentSuggestion
+	resyncs     []string
+}
+
+func (b *recordingBroadcaster) BroadcastCommit(commit models.OperationCommit, originID string) {
+	b.commits = append(b.commits, broadcastedCommit{commit: commit, originID: originID})
+}
+
+func (b *recordingBroadcaster) BroadcastSuggestion(suggestion models.DocumentSuggestion, _ *rope.Rope) {
+	b.suggestions = append(b.suggestions, suggestion)
+}
+
+func (b *recordingBroadcaster) BroadcastAccess(models.AccessChange) {}
+
+func (b *recordingBroadcaster) ResyncSubscribers(documentID string) {
+	b.resyncs = append(b.resyncs, documentID)
+}
+
+func (b *recordingBroadcaster) Subscribers(string) int { return 0 }
+
+/*
+newTestService returns a service without a database nor redis behind it:
+1. The DB runs dry, every write succeeds and every read finds nothing
+2. Nothing listens on the redis address, every redis call fails
+*/
+func newTestService(t *testing.T) (*DocumentService, *recordingBroadcaster) {
+	t.Helper()
+
+	db, err := gorm.Open(postgres.Open("host=127.0.0.1 port=1"), &gorm.Config{DryRun: true, DisableAutomaticPing: true, SkipDefaultTransaction: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", DialTimeout: 100 * time.Millisecond, MaxRetries: -1})
+	t.Cleanup(func() { unreachable.Close() })
+
+	broadcaster := &recordingBroadcaster{}
+	return NewDocumentService(db, unreachable, nil, broadcaster, NewPolicy(db)), broadcaster
+}
+
+// ownedDocument makes s the owner of an active document holding content at version,
+// caught up under lease token 7
+func ownedDocument(s *DocumentService, content string, version int) *models.OperationCache {
+	cache := models.NewOperationCache(&models.Document{ID: uuid.New(), Content: content, Version: version})
+	cache.Fence = 7
+	documentID := cache.ActiveDocument.ID.String()
+	s.operationCache.Store(documentID, cache)
+	s.ownership.leases[documentID] = lease{token: 7, expiresAt: time.Now().Add(time.Minute)}
+	return cache
+}
+
+func insertAt(version, pos int, text string) models.DocumentOperation {
+	return models.DocumentOperation{
+		ID:            uuid.New(),
+		OperationType: models.OperationTypeInsert,
+		Pos:           pos,
+		Content:       text,
+		Version:       version,
+	}
+}
+
+// relayedCache is a document at version 1 holding "a", with the given operations applied on top
+func relayedCache(ops ...models.DocumentOperation) *models.OperationCache {
+	cache := models.NewOperationCache(&models.Document{ID: uuid.New(), Content: "a", Version: 1})
+	for _, op := range ops {
+		cache.Operations = append(cache.Operations, op)
+		cache.ActiveDocument.Version = op.Version
+	}
+	return cache
+}
+
+func TestBroadcastRelayedSendsCaughtUpOperations(t *testing.T) {
+	missed := insertAt(2, 1, "b")
+	relayed := insertAt(3, 2, "c")
+	cache := relayedCache(missed, relayed)
+	broadcaster := &recordingBroadcaster{}
+	s := &DocumentService{broadcaster: broadcaster}
+
+	commit := models.OperationCommit{
+		DocumentID:  cache.ActiveDocument.ID,
+		OperationID: relayed.ID,
+		Operations:  []models.DocumentOperation{relayed},
+		Version:     3,
+	}
+	s.broadcastRelayed(cache, commit, "origin", 1, rope.New("a"))
+
+	if len(broadcaster.resyncs) != 0 {
+		t.Fatalf("resynced subscribers, want the operations")
+	}
+	if len(broadcaster.commits) != 2 {
+		t.Fatalf("broadcasted %d commits, want 2", len(broadcaster.commits))
+	}
+
+	caughtUp := broadcaster.commits[0]
+	if caughtUp.originID != "" || len(caughtUp.commit.Operations) != 1 || caughtUp.commit.Operations[0].Version != 2 {
+		t.Errorf("first broadcast = %+v, want version 2 with no origin", caughtUp)
+	}
+	if got := caughtUp.commit.Contents[1].String(); got != "ab" {
+		t.Errorf("content after version 2 = %q, want %q", got, "ab")
+	}
+
+	own := broadcaster.commits[1]
+	if own.originID != "origin" || own.commit.OperationID != relayed.ID || own.commit.Version != 3 {
+		t.Errorf("second broadcast = %+v, want the relayed commit acked to its origin", own)
+	}
+	if got := own.commit.Contents[0].String(); got != "ab" {
+		t.Errorf("content before version 3 = %q, want %q", got, "ab")
+	}
+	if got := own.commit.Contents[1].String(); got != "abc" {
+		t.Errorf("content after version 3 = %q, want %q", got, "abc")
+	}
+}
+
+func TestBroadcastRelayedAcksCommitAlreadyApplied(t *testing.T) {
+	seen := insertAt(2, 1, "b")
+	cache := relayedCache(seen)
+	broadcaster := &recordingBroadcaster{}
+	s := &DocumentService{broadcaster: broadcaster}
+
+	commit := models.OperationCommit{
+		DocumentID:  cache.ActiveDocument.ID,
+		OperationID: seen.ID,
+		Operations:  []models.DocumentOperation{seen},
+		Version:     2,
+	}
+	s.broadcastRelayed(cache, commit, "origin", 2, cache.Content)
+
+	if len(broadcaster.commits) != 1 {
+		t.Fatalf("broadcasted %d commits, want 1", len(broadcaster.commits))
+	}
+	ack := broadcaster.commits[0]
+	if !ack.commit.Duplicate || len(ack.commit.Operations) != 0 || ack.originID != "origin" {
+		t.Errorf("broadcast = %+v, want a bare ack to the origin", ack)
+	}
+}
+
+func TestBroadcastRelayedResyncsWhenOperationsAreNotCached(t *testing.T) {
+	cache := relayedCache(insertAt(3, 1, "c"))
+	broadcaster := &recordingBroadcaster{}
+	s := &DocumentService{broadcaster: broadcaster}
+
+	s.broadcastRelayed(cache, models.OperationCommit{DocumentID: cache.ActiveDocument.ID, Version: 3}, "", 1, rope.New("a"))
+
+	if len(broadcaster.resyncs) != 1 || len(broadcaster.commits) != 0 {
+		t.Errorf("resyncs = %v, commits = %d, want a resync and no commit", broadcaster.resyncs, len(broadcaster.commits))
+	}
+}
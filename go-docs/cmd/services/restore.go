@@ -0,0 +1,139 @@
+package services
+
+import (
+	"context"
+	"go-docs/cmd/models"
+	"go-docs/cmd/server/dto"
+	"go-docs/cmd/utils"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+/*
+RestoreVersion brings the document back to what it was at version, as new
+operations on top of the current one so nothing is lost and live editors
+receive it like any edit:
+1. Rebuild the content at version and diff the current content against it
+2. Turn every changed region into an insert, delete or replace
+3. Submit them from the end of the document backwards, none of them moves the
+text the next ones point at. After each one the rest is rebased on what was
+applied since, so however many there are each is based on a recent version and
+edits made meanwhile are transformed like for any other client.
+*/
+func (s *DocumentService) RestoreVersion(ctx context.Context, userID, documentID string, version int) (*dto.RestoreVersionResponse, error) {
+	if err := s.checkCapability(ctx, userID, documentID, models.CapabilityEdit); err != nil {
+		return nil, err
+	}
+
+	target, _, err := s.contentAt(documentID, version)
+	if err != nil {
+		return nil, err
+	}
+
+	cache, err := s.lockActiveDocument(documentID)
+	if err != nil {
+		return nil, err
+	}
+	current := cache.Content
+	base := cache.ActiveDocument.Version
+	parsedDocumentID := cache.ActiveDocument.ID
+	cache.Mu.Unlock()
+
+	targetRunes := target.Runes()
+	ops := restoreOperations(current.Runes(), targetRunes)
+
+	response := &dto.RestoreVersionResponse{
+		DocumentID:      documentID,
+		RestoredVersion: version,
+		Version:         base,
+		OperationCount:  len(ops),
+	}
+
+	parsedUserID := uuid.MustParse(userID)
+	for i := range ops {
+		ops[i].ID = uuid.New()
+		ops[i].DocumentID = parsedDocumentID
+		ops[i].UserID = parsedUserID
+	}
+
+	slices.Reverse(ops)
+	for len(ops) > 0 {
+		op := ops[0]
+		// A rebased operation can be split in several, each is submitted on its own
+		op.ID = uuid.New()
+		op.BaseVersion = base
+		op.Timestamp = time.Now()
+
+		commit, err := s.OperationEvent(op, "", utils.PositionUnitRune)
+		if err != nil {
+			return nil, err
+		}
+		response.Version = commit.Version
+
+		if ops, base, err = s.rebaseOperations(documentID, ops[1:], base); err != nil {
+			return nil, err
+		}
+	}
+
+	return response, nil
+}
+
+// rebaseOperations moves ops, in the order they apply and based on base, on top
+// of everything applied since and returns them with the version they are now based on
+func (s *DocumentService) rebaseOperations(documentID string, ops []models.DocumentOperation, base int) ([]models.DocumentOperation, int, error) {
+	if len(ops) == 0 {
+		return ops, base, nil
+	}
+
+	cache, err := s.lockActiveDocument(documentID)
+	if err != nil {
+		return nil, base, err
+	}
+	defer cache.Mu.Unlock()
+
+	newerVersions, err := s.operationsSince(cache, base)
+	if err != nil {
+		return nil, base, err
+	}
+
+	rebased, _ := transformLists(decomposeAll(ops), decomposeAll(newerVersions))
+	return compose(rebased), cache.ActiveDocument.Version, nil
+}
+
+// restoreOperations lists the edits turning current into target, in document
+// order, positions relative to current
+func restoreOperations(current, target []rune) []models.DocumentOperation {
+	ops := []models.DocumentOperation{}
+
+	var pending *models.DocumentOperation
+	for _, span := range utils.Diff(current, target) {
+		if span.Kind == utils.DiffEqual {
+			pending = nil
+			continue
+		}
+
+		if pending == nil {
+			ops = append(ops, models.DocumentOperation{Pos: span.AStart})
+			pending = &ops[len(ops)-1]
+		}
+
+		if span.Kind == utils.DiffDelete {
+			pending.DeleteLen += span.AEnd - span.AStart
+		} else {
+			pending.Content += string(target[span.BStart:span.BEnd])
+		}
+
+		switch {
+		case pending.DeleteLen == 0:
+			pending.OperationType = models.OperationTypeInsert
+		case pending.Content == "":
+			pending.OperationType = models.OperationTypeDelete
+		default:
+			pending.OperationType = models.OperationTypeReplace
+		}
+	}
+
+	return ops
+}
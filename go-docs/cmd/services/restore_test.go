@@ -0,0 +1,125 @@
+package services
+
+import (
+	"go-docs/cmd/models"
+	"go-docs/cmd/utils"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// restoreTo applies the restore operations the way RestoreVersion submits them, from the end backwards
+func restoreTo(t *testing.T, current string, ops []models.DocumentOperation) string {
+	t.Helper()
+
+	ops = slices.Clone(ops)
+	for i := range ops {
+		ops[i].ID = uuid.New()
+	}
+	slices.Reverse(ops)
+	return applyAll(t, current, ops)
+}
+
+func manyHunks(n int, letter string) string {
+	parts := make([]string, n)
+	for i := range parts {
+		parts[i] = letter
+	}
+	return strings.Join(parts, ".")
+}
+
+func TestRestoreOperations(t *testing.T) {
+	tests := []struct {
+		name            string
+		current, target string
+		want            int
+	}{
+		{"identical", "hello", "hello", 0},
+		{"both empty", "", "", 0},
+		{"from empty", "", "hello", 1},
+		{"to empty", "hello", "", 1},
+		{"insert", "helo", "hello", 1},
+		{"delete", "hello", "helo", 1},
+		{"replace", "hello world", "hello there", 2},
+		{"astral", "a😀b😀c", "a😃b😀c!", 2},
+		{"combining", "café", "café", 1},
+		{"many hunks", manyHunks(500, "a"), manyHunks(500, "b"), 500},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops := restoreOperations([]rune(tt.current), []rune(tt.target))
+			if len(ops) != tt.want {
+				t.Errorf("got %d operations, want %d", len(ops), tt.want)
+			}
+			for i := 1; i < len(ops); i++ {
+				if ops[i].Pos <= ops[i-1].Pos+ops[i-1].DeleteLen {
+					t.Fatalf("operations %d and %d touch or overlap: %+v, %+v", i-1, i, ops[i-1], ops[i])
+				}
+			}
+			if got := restoreTo(t, tt.current, ops); got != tt.target {
+				t.Errorf("restored %q, want %q", got, tt.target)
+			}
+		})
+	}
+}
+
+// commitTo applies op to the cache as the next version, the way submitOperation does
+func commitTo(t *testing.T, cache *models.OperationCache, op models.DocumentOperation) {
+	t.Helper()
+
+	content, err := utils.ApplyOperation(cache.Content, op)
+	if err != nil {
+		t.Fatalf("applying %+v: %v", op, err)
+	}
+	cache.Content = content
+	cache.ActiveDocument.Version++
+	op.Version = cache.ActiveDocument.Version
+	cache.Operations = append(cache.Operations, op)
+	if len(cache.Operations) > maxCachedOperations {
+		cache.Operations = cache.Operations[len(cache.Operations)-maxCachedOperations:]
+	}
+}
+
+/*
+A restore with more operations than the cache keeps, while somebody else edits
+the start of the document. Based on the version the restore started at, the
+last ones would fall out of the window, rebased after each one they never do.
+*/
+func TestRebaseOperationsKeepsRestoreOnRecentVersions(t *testing.T) {
+	s, _ := newTestService(t)
+	current, target := "start "+manyHunks(300, "a"), "start "+manyHunks(300, "b")
+	cache := ownedDocument(s, current, 10)
+	documentID := cache.ActiveDocument.ID.String()
+
+	ops := restoreOperations([]rune(current), []rune(target))
+	for i := range ops {
+		ops[i].ID = uuid.New()
+		ops[i].UserID = userA
+	}
+	slices.Reverse(ops)
+
+	base := cache.ActiveDocument.Version
+	for n := 0; len(ops) > 0; n++ {
+		op := ops[0]
+		op.ID = uuid.New()
+		commitTo(t, cache, op)
+		if n%50 == 0 {
+			commitTo(t, cache, insertOp(userB, 0, "z"))
+		}
+
+		var err error
+		if ops, base, err = s.rebaseOperations(documentID, ops[1:], base); err != nil {
+			t.Fatalf("rebasing after %d operations: %v", n+1, err)
+		}
+		if len(ops) > 0 && base != cache.ActiveDocument.Version {
+			t.Fatalf("rebased on version %d, want %d", base, cache.ActiveDocument.Version)
+		}
+	}
+
+	if got, want := cache.Content.String(), "zzzzzz"+target; got != want {
+		t.Errorf("restored %q, want %q", got, want)
+	}
+}
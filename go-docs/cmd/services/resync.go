@@ -0,0 +1,63 @@
+package services
+
+import (
+	"fmt"
+	"go-docs/cmd/models"
+)
+
+/*
+ResyncRequiredError rejects an operation based on a version that is no longer
+in the retained window, transforming it against a partial history would
+corrupt the document. The client rebases its pending operations either on
+Operations, everything applied after BaseVersion, or when the log cannot
+provide them on the Document snapshot.
+*/
+type ResyncRequiredError struct {
+	BaseVersion int                        `json:"base_version"`
+	Version     int                        `json:"version"`
+	Operations  []models.DocumentOperation `json:"operations,omitempty"`
+	Document    *models.Document           `json:"document,omitempty"`
+}
+
+func (e *ResyncRequiredError) Error() string {
+	return fmt.Sprintf("operation is based on version %d but the document is at version %d, resync required", e.BaseVersion, e.Version)
+}
+
+// operationsSince returns every operation applied after baseVersion, the cache lock must be held
+func (s *DocumentService) operationsSince(cache *models.OperationCache, baseVersion int) ([]models.DocumentOperation, error) {
+	document := cache.ActiveDocument
+
+	if baseVersion < 0 || baseVersion > document.Version {
+		snapshot := cache.Snapshot()
+		return nil, &ResyncRequiredError{BaseVersion: baseVersion, Version: document.Version, Document: &snapshot}
+	}
+
+	if len(cache.Operations) > 0 && cache.Operations[0].Version <= baseVersion+1 {
+		operations := []models.DocumentOperation{}
+		for _, op := range cache.Operations {
+			if op.Version > baseVersion {
+				operations = append(operations, op)
+			}
+		}
+		return operations, nil
+	}
+
+	// Outside the window we keep in memory, hand the client what it missed from the log
+	missing := []models.DocumentOperation{}
+	err := s.db.Where("document_id = ? AND version > ? AND version <= ?", document.ID, baseVersion, document.Version).
+		Order("version ASC").
+		Find(&missing).Error
+	if err != nil {
+		return nil, err
+	}
+
+	resync := &ResyncRequiredError{BaseVersion: baseVersion, Version: document.Version}
+	if len(missing) == document.Version-baseVersion {
+		resync.Operations = missing
+	} else {
+		snapshot := cache.Snapshot()
+		resync.Document = &snapshot
+	}
+
+	return nil, resync
+}
@@ -0,0 +1,158 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"go-docs/cmd/models"
+	"go-docs/cmd/server/dto"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrSnapshotNameTaken = errors.New("this document already has a version with this name")
+	ErrSnapshotNotFound  = errors.New("this named version does not exist")
+)
+
+/*
+CreateSnapshot names a version of the document:
+1. Rebuild the content at that version, or take the live one
+2. Store it along with the name, so the snapshot never depends on the
+operation log or checkpoints being kept around
+*/
+func (s *DocumentService) CreateSnapshot(ctx context.Context, userID, documentID string, request dto.CreateSnapshotRequest) (*models.DocumentSnapshot, error) {
+	if err := s.checkCapability(ctx, userID, documentID, models.CapabilityEdit); err != nil {
+		return nil, err
+	}
+	if err := s.checkSnapshotName(documentID, "", request.Name); err != nil {
+		return nil, err
+	}
+
+	snapshot := &models.DocumentSnapshot{
+		DocumentID:  uuid.MustParse(documentID),
+		Name:        request.Name,
+		Description: request.Description,
+		CreatedByID: uuid.MustParse(userID),
+	}
+
+	if request.Version == nil {
+		cache, err := s.lockActiveDocument(documentID)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Version = cache.ActiveDocument.Version
+		content := cache.Content
+		cache.Mu.Unlock()
+		snapshot.Content = content.String()
+	} else {
+		content, _, err := s.contentAt(documentID, *request.Version)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Version = *request.Version
+		snapshot.Content = content.String()
+	}
+
+	if err := s.db.Create(snapshot).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(snapshot).Association("CreatedBy").Find(&snapshot.CreatedBy); err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// GetSnapshots lists the named versions of a document, newest version first and without their content
+func (s *DocumentService) GetSnapshots(ctx context.Context, userID, documentID string) ([]models.DocumentSnapshot, error) {
+	if err := s.checkCapability(ctx, userID, documentID, models.CapabilityView); err != nil {
+		return nil, err
+	}
+
+	snapshots := []models.DocumentSnapshot{}
+	err := s.db.Omit("content").Preload("CreatedBy").
+		Where("document_id = ?", documentID).
+		Order("version DESC, created_at DESC").
+		Find(&snapshots).Error
+	return snapshots, err
+}
+
+func (s *DocumentService) GetSnapshot(ctx context.Context, userID, documentID, snapshotID string) (*models.DocumentSnapshot, error) {
+	if err := s.checkCapability(ctx, userID, documentID, models.CapabilityView); err != nil {
+		return nil, err
+	}
+
+	snapshot := &models.DocumentSnapshot{}
+	err := s.db.Preload("CreatedBy").Where("id = ? AND document_id = ?", snapshotID, documentID).First(snapshot).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrSnapshotNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// UpdateSnapshot renames a named version, the version and content it pins never change
+func (s *DocumentService) UpdateSnapshot(ctx context.Context, userID, documentID, snapshotID string, request dto.UpdateSnapshotRequest) (*models.DocumentSnapshot, error) {
+	if err := s.checkCapability(ctx, userID, documentID, models.CapabilityEdit); err != nil {
+		return nil, err
+	}
+	if err := s.checkSnapshotName(documentID, snapshotID, request.Name); err != nil {
+		return nil, err
+	}
+
+	result := s.db.Model(&models.DocumentSnapshot{}).
+		Where("id = ? AND document_id = ?", snapshotID, documentID).
+		Updates(map[string]any{"name": request.Name, "description": request.Description})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrSnapshotNotFound
+	}
+
+	return s.GetSnapshot(ctx, userID, documentID, snapshotID)
+}
+
+func (s *DocumentService) DeleteSnapshot(ctx context.Context, userID, documentID, snapshotID string) error {
+	if err := s.checkCapability(ctx, userID, documentID, models.CapabilityEdit); err != nil {
+		return err
+	}
+
+	result := s.db.Where("id = ? AND document_id = ?", snapshotID, documentID).Delete(&models.DocumentSnapshot{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrSnapshotNotFound
+	}
+	return nil
+}
+
+// checkSnapshotName makes sure no other snapshot of the document goes by name
+func (s *DocumentService) checkSnapshotName(documentID, snapshotID, name string) error {
+	query := s.db.Model(&models.DocumentSnapshot{}).Where("document_id = ? AND name = ?", documentID, name)
+	if snapshotID != "" {
+		query = query.Where("id <> ?", snapshotID)
+	}
+
+	var taken int64
+	if err := query.Count(&taken).Error; err != nil {
+		return err
+	}
+	if taken > 0 {
+		return ErrSnapshotNameTaken
+	}
+	return nil
+}
+
+// snapshotsBetween lists the named versions from version from to version to, both included, without their content
+func (s *DocumentService) snapshotsBetween(documentID string, from, to int) ([]models.DocumentSnapshot, error) {
+	snapshots := []models.DocumentSnapshot{}
+	err := s.db.Omit("content").Preload("CreatedBy").
+		Where("document_id = ? AND version >= ? AND version <= ?", documentID, from, to).
+		Order("version DESC, created_at DESC").
+		Find(&snapshots).Error
+	return snapshots, err
+}
@@ -0,0 +1,160 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go-docs/cmd/models"
+	"go-docs/cmd/utils"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+Redis holds every active document as a snapshot plus a stream of the
+operations applied after it:
+1. The owner XADDs each operation to document:<id>:stream, the entry ID being
+the version it produced
+2. A flush writes a compacted snapshot under the document ID and trims the
+stream up to its version
+3. Both keys expire once the document is left alone, the DB has it all by then
+A replica rebuilds the document from the snapshot and the stream tail, and
+only replays from the DB log what redis no longer has.
+*/
+
+const documentRedisTTL = 24 * time.Hour
+
+func streamKey(documentID string) string {
+	return "document:" + documentID + ":stream"
+}
+
+// Appends the operations {entry ID, payload}... unless a newer lease has been handed out since ours
+var fencedAppendScript = redis.NewScript(`
+local fence = redis.call('GET', KEYS[2])
+if fence and tonumber(fence) > tonumber(ARGV[1]) then
+	return 0
+end
+for i = 3, #ARGV, 2 do
+	redis.call('XADD', KEYS[1], ARGV[i], 'op', ARGV[i + 1])
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return 1
+`)
+
+// Writes a snapshot over an older one and compacts the stream it covers
+var snapshotScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if current and tonumber(cjson.decode(current).version) > tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[3])
+redis.call('XTRIM', KEYS[2], 'MINID', tonumber(ARGV[2]) + 1)
+return 1
+`)
+
+func streamEntryID(version int) string {
+	return strconv.Itoa(version) + "-0"
+}
+
+// appendOperationsFenced streams ops only if token still belongs to the newest lease on the document
+func (s *DocumentService) appendOperationsFenced(documentID string, ops []models.DocumentOperation, token int64) (bool, error) {
+	args := []any{token, documentRedisTTL.Milliseconds()}
+	for _, op := range ops {
+		data, err := json.Marshal(op)
+		if err != nil {
+			return false, err
+		}
+		args = append(args, streamEntryID(op.Version), data)
+	}
+
+	saved, err := fencedAppendScript.Run(context.Background(), s.redis, []string{streamKey(documentID), fenceKey(documentID)}, args...).Int()
+	if err != nil {
+		return false, err
+	}
+	return saved == 1, nil
+}
+
+// saveSnapshotToRedis replaces the snapshot unless it is already at a newer version
+func (s *DocumentService) saveSnapshotToRedis(document *models.Document) error {
+	data, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+
+	documentID := document.ID.String()
+	return snapshotScript.Run(context.Background(), s.redis,
+		[]string{documentID, streamKey(documentID)},
+		data, document.Version, documentRedisTTL.Milliseconds(),
+	).Err()
+}
+
+// streamedOperations reads the operations streamed after version, they are
+// only usable if the first one follows version directly.
+func (s *DocumentService) streamedOperations(documentID string, version int) ([]models.DocumentOperation, error) {
+	entries, err := s.redis.XRange(context.Background(), streamKey(documentID), "("+streamEntryID(version), "+").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	ops := make([]models.DocumentOperation, 0, len(entries))
+	for _, entry := range entries {
+		payload, ok := entry.Values["op"].(string)
+		if !ok {
+			return nil, fmt.Errorf("stream entry %s of document %s has no operation", entry.ID, documentID)
+		}
+
+		op := models.DocumentOperation{}
+		if err := json.Unmarshal([]byte(payload), &op); err != nil {
+			return nil, err
+		}
+		if entry.ID != streamEntryID(op.Version) {
+			return nil, fmt.Errorf("stream entry %s of document %s holds version %d", entry.ID, documentID, op.Version)
+		}
+		ops = append(ops, op)
+	}
+
+	return ops, nil
+}
+
+/*
+catchUp applies the operations the cached document is missing, the cache lock
+must be held:
+1. Replay the redis stream tail while it follows on from our version
+2. Replay whatever is left from the operation log, the source of truth
+*/
+func (s *DocumentService) catchUp(cache *models.OperationCache) error {
+	document := cache.ActiveDocument
+	documentID := document.ID.String()
+
+	streamed, err := s.streamedOperations(documentID, document.Version)
+	if err != nil {
+		log.Printf("Failed to read the operation stream of document %s: %v", documentID, err)
+	}
+
+	for _, op := range streamed {
+		if op.Version != document.Version+1 {
+			// Trimmed or expired in between, the log has the rest
+			break
+		}
+
+		content, err := utils.ApplyOperation(cache.Content, op)
+		if err != nil {
+			break
+		}
+		cache.Content = content
+		document.Version = op.Version
+		applyBlame(cache, op)
+		applySuggestions(cache, op)
+		cache.Operations = append(cache.Operations, op)
+		cache.Dirty = true
+		s.rememberOperation(cache, op.ID, op.Version)
+	}
+	if len(cache.Operations) > maxCachedOperations {
+		cache.Operations = cache.Operations[len(cache.Operations)-maxCachedOperations:]
+	}
+
+	return s.catchUpFromLog(cache)
+}
@@ -0,0 +1,484 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"go-docs/cmd/models"
+	"go-docs/cmd/utils"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrSuggestionNotFound   = errors.New("this suggestion does not exist or is already resolved")
+	ErrSuggestionConflict   = errors.New("the text this suggestion replaces was edited since, it is still pending")
+	errSuggestionUnanchored = errors.New("the operations since this suggestion are no longer in the log")
+)
+
+/*
+SuggestEvent records op as a pending suggestion instead of applying it, on the
+owner of the document like any operation:
+1. Convert op to runes and move its range through everything applied after
+op.BaseVersion, the same way an operation would be transformed
+2. Store it anchored at the current version, along with the text it replaces
+3. Keep it in the active document, where every operation moves it, and tell
+the subscribers here and on the other instances about it
+Suggesting the same operation ID again stores nothing and returns the suggestion
+it made the first time.
+*/
+func (s *DocumentService) SuggestEvent(op models.DocumentOperation, unit utils.PositionUnit) (*models.DocumentSuggestion, error) {
+	return s.submitSuggestion(op, unit, true)
+}
+
+// submitSuggestion records op if we own the document, forwarding it at most once like submitOperation
+func (s *DocumentService) submitSuggestion(op models.DocumentOperation, unit utils.PositionUnit, allowForward bool) (*models.DocumentSuggestion, error) {
+	ctx := context.Background()
+	documentID := op.DocumentID.String()
+
+	if err := utils.ValidateOperation(op); err != nil {
+		return nil, err
+	}
+
+	owner, token, err := s.ownership.claim(ctx, documentID)
+	if err != nil {
+		return nil, err
+	}
+
+	if owner != s.nodeID {
+		if !allowForward {
+			return nil, errNotDocumentOwner
+		}
+		result, err := s.ownership.forward(ctx, owner, forwardedOperation{Unit: unit, Operation: op, Suggest: true})
+		if err != nil {
+			return nil, err
+		}
+		return result.Suggestion, nil
+	}
+
+	cache, err := s.lockActiveDocument(documentID)
+	if err != nil {
+		return nil, err
+	}
+	defer cache.Mu.Unlock()
+
+	if cache.Fence != token {
+		if err := s.catchUp(cache); err != nil {
+			return nil, err
+		}
+		cache.Fence = token
+	}
+
+	// A client resending after a reconnect gets the suggestion it already made
+	if existing, err := s.existingSuggestion(cache, op); err != nil || existing != nil {
+		return existing, err
+	}
+
+	document := cache.ActiveDocument
+
+	newerVersions := []models.DocumentOperation{}
+	if op.BaseVersion != document.Version {
+		newerVersions, err = s.operationsSince(cache, op.BaseVersion)
+
+		var resync *ResyncRequiredError
+		if errors.As(err, &resync) {
+			return nil, resyncIn(resync, cache, unit)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if op, err = operationToRunes(cache.Content, op, newerVersions, unit); err != nil {
+		return nil, err
+	}
+
+	start, end := op.Pos, op.Pos
+	if op.OperationType != models.OperationTypeInsert {
+		end += op.DeleteLen
+	}
+	for _, newer := range newerVersions {
+		start, end = utils.TransformRange(start, end, newer)
+	}
+	if end > cache.Content.Len() {
+		return nil, &utils.InvalidOperationError{OperationID: op.ID.String(), Reason: "suggestion goes past the end of the document"}
+	}
+
+	suggestion := models.DocumentSuggestion{
+		ID:            op.ID,
+		DocumentID:    op.DocumentID,
+		UserID:        op.UserID,
+		OperationType: op.OperationType,
+		Pos:           start,
+		DeleteLen:     end - start,
+		Content:       op.Content,
+		Deleted:       cache.Content.Slice(start, end),
+		Version:       document.Version,
+		Status:        models.SuggestionStatusPending,
+	}
+	if err := s.db.Create(&suggestion).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(&suggestion).Association("User").Find(&suggestion.User); err != nil {
+		return nil, err
+	}
+
+	if cache.Suggestions != nil {
+		cache.Suggestions = append(cache.Suggestions, suggestion)
+	}
+	s.announceSuggestion(cache, suggestion)
+
+	return &suggestion, nil
+}
+
+// existingSuggestion finds the suggestion op already made, announcing it again
+// while it is pending, the cache lock must be held
+func (s *DocumentService) existingSuggestion(cache *models.OperationCache, op models.DocumentOperation) (*models.DocumentSuggestion, error) {
+	for _, suggestion := range cache.Suggestions {
+		if suggestion.ID == op.ID {
+			s.announceSuggestion(cache, suggestion)
+			return &suggestion, nil
+		}
+	}
+
+	suggestion := models.DocumentSuggestion{}
+	err := s.db.Preload("User").Where("id = ?", op.ID).First(&suggestion).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if suggestion.DocumentID != op.DocumentID {
+		return nil, &utils.InvalidOperationError{OperationID: op.ID.String(), Reason: "this ID is already used by a suggestion on another document"}
+	}
+	return &suggestion, nil
+}
+
+// GetSuggestions lists the suggestions of a document with status, the pending
+// ones anchored on the live document and counted in unit
+func (s *DocumentService) GetSuggestions(ctx context.Context, userID, documentID string, status models.SuggestionStatus, unit utils.PositionUnit) ([]models.DocumentSuggestion, error) {
+	if err := s.checkCapability(ctx, userID, documentID, models.CapabilityView); err != nil {
+		return nil, err
+	}
+
+	if status != models.SuggestionStatusPending {
+		suggestions := []models.DocumentSuggestion{}
+		err := s.db.Preload("User").
+			Where("document_id = ? AND status = ?", documentID, status).
+			Order("resolved_at DESC").
+			Find(&suggestions).Error
+		return suggestions, err
+	}
+
+	cache, err := s.lockActiveDocument(documentID)
+	if err != nil {
+		return nil, err
+	}
+	defer cache.Mu.Unlock()
+
+	suggestions := make([]models.DocumentSuggestion, len(cache.Suggestions))
+	for i, suggestion := range cache.Suggestions {
+		suggestions[i] = utils.ConvertSuggestion(cache.Content, suggestion, unit)
+	}
+	return suggestions, nil
+}
+
+/*
+AcceptSuggestion turns a pending suggestion into an operation, only the
+document owners may:
+1. Mark it accepted, which only one request can do
+2. Check its anchor still holds the text it replaces, text written inside it
+since would be deleted with it otherwise
+3. Submit it where its anchor is now, based on the current version so it goes
+through the transform like any edit. It is credited to whoever suggested it.
+4. Drop it from the active documents
+A failure leaves it pending, an edited anchor fails with ErrSuggestionConflict.
+*/
+func (s *DocumentService) AcceptSuggestion(ctx context.Context, userID, documentID, suggestionID string) (*models.DocumentSuggestion, error) {
+	if err := s.checkCapability(ctx, userID, documentID, models.CapabilityManageCollaborators); err != nil {
+		return nil, err
+	}
+
+	if err := s.claimSuggestion(userID, documentID, suggestionID, models.SuggestionStatusAccepted); err != nil {
+		return nil, err
+	}
+
+	suggestion, op, err := s.suggestedOperation(documentID, suggestionID)
+	if err == nil && (op.DeleteLen > 0 || op.Content != "") {
+		// A deletion whose text is already gone has nothing left to apply
+		_, err = s.OperationEvent(op, "", utils.PositionUnitRune)
+	}
+	if err != nil {
+		s.unclaimSuggestion(suggestionID)
+		return nil, err
+	}
+
+	return s.resolveSuggestion(documentID, suggestion)
+}
+
+// RejectSuggestion drops a pending suggestion, the document owners and whoever suggested it may
+func (s *DocumentService) RejectSuggestion(ctx context.Context, userID, documentID, suggestionID string) (*models.DocumentSuggestion, error) {
+	suggestion := models.DocumentSuggestion{}
+	err := s.db.Where("id = ? AND document_id = ? AND status = ?", suggestionID, documentID, models.SuggestionStatusPending).
+		First(&suggestion).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrSuggestionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if suggestion.UserID.String() != userID {
+		if err := s.checkCapability(ctx, userID, documentID, models.CapabilityManageCollaborators); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.claimSuggestion(userID, documentID, suggestionID, models.SuggestionStatusRejected); err != nil {
+		return nil, err
+	}
+
+	return s.resolveSuggestion(documentID, suggestion)
+}
+
+// claimSuggestion resolves a pending suggestion in the DB, a suggestion already resolved is not found
+func (s *DocumentService) claimSuggestion(userID, documentID, suggestionID string, status models.SuggestionStatus) error {
+	result := s.db.Model(&models.DocumentSuggestion{}).
+		Where("id = ? AND document_id = ? AND status = ?", suggestionID, documentID, models.SuggestionStatusPending).
+		Updates(map[string]any{"status": status, "resolved_by_id": userID, "resolved_at": time.Now()})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrSuggestionNotFound
+	}
+	return nil
+}
+
+func (s *DocumentService) unclaimSuggestion(suggestionID string) {
+	err := s.db.Model(&models.DocumentSuggestion{}).Where("id = ?", suggestionID).
+		Updates(map[string]any{"status": models.SuggestionStatusPending, "resolved_by_id": nil, "resolved_at": nil}).Error
+	if err != nil {
+		log.Printf("Failed to set suggestion %s back to pending: %v", suggestionID, err)
+	}
+}
+
+// suggestedOperation builds the operation applying a suggestion where it is anchored in the live document
+func (s *DocumentService) suggestedOperation(documentID, suggestionID string) (models.DocumentSuggestion, models.DocumentOperation, error) {
+	cache, err := s.lockActiveDocument(documentID)
+	if err != nil {
+		return models.DocumentSuggestion{}, models.DocumentOperation{}, err
+	}
+	defer cache.Mu.Unlock()
+
+	suggestion, err := s.anchoredSuggestion(cache, suggestionID)
+	if err != nil {
+		return suggestion, models.DocumentOperation{}, err
+	}
+
+	op := models.DocumentOperation{
+		ID:            uuid.New(),
+		DocumentID:    suggestion.DocumentID,
+		UserID:        suggestion.UserID,
+		OperationType: models.OperationTypeReplace,
+		Pos:           suggestion.Pos,
+		DeleteLen:     suggestion.DeleteLen,
+		Content:       suggestion.Content,
+		BaseVersion:   cache.ActiveDocument.Version,
+		Timestamp:     time.Now(),
+	}
+	switch {
+	case op.DeleteLen == 0:
+		op.OperationType = models.OperationTypeInsert
+	case op.Content == "":
+		op.OperationType = models.OperationTypeDelete
+	}
+
+	// The anchor grows around text inserted inside it, and shrinks with text
+	// deleted from it. A deletion whose text is entirely gone is left alone.
+	if op.DeleteLen > 0 || op.Content != "" {
+		if cache.Content.Slice(op.Pos, op.Pos+op.DeleteLen) != suggestion.Deleted {
+			return suggestion, op, ErrSuggestionConflict
+		}
+	}
+
+	return suggestion, op, nil
+}
+
+// anchoredSuggestion finds a suggestion as anchored at the cached version, the cache lock must be held
+func (s *DocumentService) anchoredSuggestion(cache *models.OperationCache, suggestionID string) (models.DocumentSuggestion, error) {
+	for _, suggestion := range cache.Suggestions {
+		if suggestion.ID.String() == suggestionID {
+			return suggestion, nil
+		}
+	}
+
+	// Suggested on another instance and not relayed here yet
+	suggestion := models.DocumentSuggestion{}
+	if err := s.db.Preload("User").Where("id = ?", suggestionID).First(&suggestion).Error; err != nil {
+		return suggestion, err
+	}
+	return suggestion, s.rebaseSuggestion(cache, &suggestion)
+}
+
+// resolveSuggestion drops a resolved suggestion from the active documents and tells the subscribers
+func (s *DocumentService) resolveSuggestion(documentID string, suggestion models.DocumentSuggestion) (*models.DocumentSuggestion, error) {
+	resolved := models.DocumentSuggestion{}
+	if err := s.db.Preload("User").Where("id = ?", suggestion.ID).First(&resolved).Error; err != nil {
+		return nil, err
+	}
+
+	cache, err := s.lockActiveDocument(documentID)
+	if err != nil {
+		return nil, err
+	}
+	defer cache.Mu.Unlock()
+
+	removeSuggestion(cache, resolved.ID)
+	s.announceSuggestion(cache, resolved)
+
+	return &resolved, nil
+}
+
+// announceSuggestion tells the local subscribers and the other instances about a new or resolved suggestion, the cache lock must be held
+func (s *DocumentService) announceSuggestion(cache *models.OperationCache, suggestion models.DocumentSuggestion) {
+	if s.broadcaster != nil {
+		s.broadcaster.BroadcastSuggestion(suggestion, cache.Content)
+	}
+
+	data, err := json.Marshal(relayedCommit{NodeID: s.nodeID, Suggestion: &suggestion})
+	if err == nil {
+		err = s.redis.Publish(context.Background(), operationChannel(suggestion.DocumentID.String()), data).Err()
+	}
+	if err != nil {
+		log.Printf("Failed to publish suggestion %s: %v", suggestion.ID.String(), err)
+	}
+}
+
+// applyRelayedSuggestion updates the active document with a suggestion made or resolved on another instance
+func (s *DocumentService) applyRelayedSuggestion(suggestion models.DocumentSuggestion) {
+	documentID := suggestion.DocumentID.String()
+	if _, ok := s.operationCache.Load(documentID); !ok {
+		// Loaded from the DB when needed
+		return
+	}
+
+	cache, err := s.lockActiveDocument(documentID)
+	if err != nil {
+		log.Printf("Failed to load document %s for suggestion %s: %v", documentID, suggestion.ID.String(), err)
+		return
+	}
+	defer cache.Mu.Unlock()
+
+	removeSuggestion(cache, suggestion.ID)
+	if suggestion.Status == models.SuggestionStatusPending && cache.Suggestions != nil {
+		if err := s.rebaseSuggestion(cache, &suggestion); err != nil {
+			log.Printf("Failed to anchor suggestion %s: %v", suggestion.ID.String(), err)
+			return
+		}
+		cache.Suggestions = append(cache.Suggestions, suggestion)
+	}
+
+	if s.broadcaster != nil {
+		s.broadcaster.BroadcastSuggestion(suggestion, cache.Content)
+	}
+}
+
+/*
+rebaseSuggestion moves the anchor of a suggestion to the cached version, the
+cache lock must be held:
+1. Catch up first if it was anchored on a version we have not seen yet
+2. Move it through every operation applied since it was anchored
+*/
+func (s *DocumentService) rebaseSuggestion(cache *models.OperationCache, suggestion *models.DocumentSuggestion) error {
+	document := cache.ActiveDocument
+
+	if suggestion.Version > document.Version {
+		if err := s.catchUp(cache); err != nil {
+			return err
+		}
+	}
+	if suggestion.Version == document.Version {
+		return nil
+	}
+
+	ops, err := s.operationsSince(cache, suggestion.Version)
+	var resync *ResyncRequiredError
+	if errors.As(err, &resync) {
+		if resync.Operations == nil {
+			return errSuggestionUnanchored
+		}
+		ops = resync.Operations
+	} else if err != nil {
+		return err
+	}
+
+	for _, op := range ops {
+		transformSuggestion(suggestion, op)
+	}
+	return nil
+}
+
+// applySuggestions moves the pending suggestions along with an operation applied to the cache, the cache lock must be held
+func applySuggestions(cache *models.OperationCache, op models.DocumentOperation) {
+	for i := range cache.Suggestions {
+		transformSuggestion(&cache.Suggestions[i], op)
+	}
+}
+
+func transformSuggestion(suggestion *models.DocumentSuggestion, op models.DocumentOperation) {
+	if op.Version <= suggestion.Version {
+		return
+	}
+
+	start, end := utils.TransformRange(suggestion.Pos, suggestion.Pos+suggestion.DeleteLen, op)
+	suggestion.Pos = start
+	suggestion.DeleteLen = end - start
+	suggestion.Version = op.Version
+}
+
+func removeSuggestion(cache *models.OperationCache, suggestionID uuid.UUID) {
+	for i, suggestion := range cache.Suggestions {
+		if suggestion.ID == suggestionID {
+			cache.Suggestions = append(cache.Suggestions[:i:i], cache.Suggestions[i+1:]...)
+			return
+		}
+	}
+}
+
+// loadSuggestions anchors the pending suggestions of a freshly loaded document at its version
+func (s *DocumentService) loadSuggestions(cache *models.OperationCache) error {
+	suggestions := []models.DocumentSuggestion{}
+	err := s.db.Preload("User").
+		Where("document_id = ? AND status = ?", cache.ActiveDocument.ID, models.SuggestionStatusPending).
+		Order("created_at ASC").
+		Find(&suggestions).Error
+	if err != nil {
+		return err
+	}
+
+	cache.Suggestions = []models.DocumentSuggestion{}
+	for _, suggestion := range suggestions {
+		if err := s.rebaseSuggestion(cache, &suggestion); err != nil {
+			// Left pending in the DB, it can still be rejected
+			log.Printf("Failed to anchor suggestion %s: %v", suggestion.ID.String(), err)
+			continue
+		}
+		cache.Suggestions = append(cache.Suggestions, suggestion)
+	}
+	return nil
+}
+
+// saveSuggestions stores where the pending suggestions are anchored now, so
+// loading them again replays less. The cache lock must be held.
+func (s *DocumentService) saveSuggestions(cache *models.OperationCache) {
+	for _, suggestion := range cache.Suggestions {
+		err := s.db.Model(&models.DocumentSuggestion{}).
+			Where("id = ? AND status = ? AND version < ?", suggestion.ID, models.SuggestionStatusPending, suggestion.Version).
+			Updates(map[string]any{"pos": suggestion.Pos, "delete_len": suggestion.DeleteLen, "version": suggestion.Version}).Error
+		if err != nil {
+			log.Printf("Failed to save the anchor of suggestion %s: %v", suggestion.ID.String(), err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package services
+
+import (
+	"errors"
+	"go-docs/cmd/models"
+	"go-docs/cmd/utils"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// A client resending a suggestion after a reconnect must get the one it made
+// back, not a failure on the unique ID
+func TestSuggestEventReturnsExistingSuggestion(t *testing.T) {
+	s, broadcaster := newTestService(t)
+	cache := ownedDocument(s, "hello", 5)
+
+	op := insertAt(0, 0, "oh ")
+	op.DocumentID = cache.ActiveDocument.ID
+	op.BaseVersion = 3
+	// Made at version 3, moved along to version 5 since
+	cache.Suggestions = []models.DocumentSuggestion{{
+		ID:            op.ID,
+		DocumentID:    op.DocumentID,
+		OperationType: op.OperationType,
+		Pos:           2,
+		Content:       op.Content,
+		Version:       5,
+		Status:        models.SuggestionStatusPending,
+	}}
+
+	suggestion, err := s.SuggestEvent(op, utils.PositionUnitRune)
+	if err != nil {
+		t.Fatalf("SuggestEvent failed on a resent suggestion: %v", err)
+	}
+	if suggestion.ID != op.ID || suggestion.Pos != 2 || suggestion.Version != 5 {
+		t.Errorf("got %+v, want the existing suggestion at 2 on version 5", suggestion)
+	}
+	if len(cache.Suggestions) != 1 {
+		t.Errorf("%d pending suggestions, want the existing one only", len(cache.Suggestions))
+	}
+	if len(broadcaster.suggestions) != 1 || broadcaster.suggestions[0].ID != op.ID {
+		t.Errorf("broadcasted %+v, want the existing suggestion announced again", broadcaster.suggestions)
+	}
+}
+
+// Accepting a suggestion whose anchor grew around text typed since would delete that text
+func TestSuggestedOperationConflictsWhenAnchorWasEdited(t *testing.T) {
+	s, _ := newTestService(t)
+	cache := ownedDocument(s, "hello", 5)
+	documentID := cache.ActiveDocument.ID.String()
+
+	suggestion := models.DocumentSuggestion{
+		ID:            uuid.New(),
+		DocumentID:    cache.ActiveDocument.ID,
+		OperationType: models.OperationTypeReplace,
+		Pos:           1,
+		DeleteLen:     3,
+		Content:       "ipp",
+		Deleted:       "ell",
+		Version:       5,
+		Status:        models.SuggestionStatusPending,
+	}
+	cache.Suggestions = []models.DocumentSuggestion{suggestion}
+
+	_, op, err := s.suggestedOperation(documentID, suggestion.ID.String())
+	if err != nil {
+		t.Fatalf("suggestedOperation on an untouched anchor: %v", err)
+	}
+	if op.Pos != 1 || op.DeleteLen != 3 || op.Content != "ipp" {
+		t.Errorf("got %+v, want a replace of 1+3 with %q", op, "ipp")
+	}
+
+	commitTo(t, cache, insertAt(6, 2, "X"))
+	applySuggestions(cache, cache.Operations[len(cache.Operations)-1])
+
+	if _, _, err := s.suggestedOperation(documentID, suggestion.ID.String()); !errors.Is(err, ErrSuggestionConflict) {
+		t.Errorf("suggestedOperation over %q returned %v, want ErrSuggestionConflict", cache.Content.String(), err)
+	}
+}
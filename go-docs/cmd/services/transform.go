@@ -0,0 +1,180 @@
+package services
+
+import (
+	"go-docs/cmd/models"
+	"unicode/utf8"
+)
+
+/*
+Operational transform for insert, delete and replace.
+
+Both sides are handled as lists of operations applied one after another, a
+replace being a delete followed by an insert at the same position. Transforming
+one operation can produce several (a delete split around a concurrent insert)
+or none (text already deleted by somebody else).
+
+For every pair of concurrent operations a and b:
+apply(apply(doc, a), transform(b, a)) == apply(apply(doc, b), transform(a, b))
+Two inserts at the same position are ordered by user ID, then by operation ID,
+so every replica picks the same order whichever it received first.
+*/
+func (s *DocumentService) operationalTransform(incoming models.DocumentOperation, applied []models.DocumentOperation) []models.DocumentOperation {
+	transformed, _ := transformLists(decompose(incoming), decomposeAll(applied))
+	return compose(transformed)
+}
+
+// decompose turns op into inserts and deletes, dropping the parts that do nothing
+func decompose(op models.DocumentOperation) []models.DocumentOperation {
+	ops := []models.DocumentOperation{}
+
+	switch op.OperationType {
+	case models.OperationTypeInsert:
+		if op.Content != "" {
+			op.DeleteLen = 0
+			ops = append(ops, op)
+		}
+	case models.OperationTypeDelete:
+		if op.DeleteLen > 0 {
+			op.Content = ""
+			ops = append(ops, op)
+		}
+	case models.OperationTypeReplace:
+		if op.DeleteLen > 0 {
+			deleteOp := op
+			deleteOp.OperationType = models.OperationTypeDelete
+			deleteOp.Content = ""
+			ops = append(ops, deleteOp)
+		}
+		if op.Content != "" {
+			insertOp := op
+			insertOp.OperationType = models.OperationTypeInsert
+			insertOp.DeleteLen = 0
+			ops = append(ops, insertOp)
+		}
+	}
+
+	return ops
+}
+
+func decomposeAll(ops []models.DocumentOperation) []models.DocumentOperation {
+	result := []models.DocumentOperation{}
+	for _, op := range ops {
+		result = append(result, decompose(op)...)
+	}
+	return result
+}
+
+// compose merges a delete directly followed by an insert at the same position back into a replace
+func compose(ops []models.DocumentOperation) []models.DocumentOperation {
+	result := []models.DocumentOperation{}
+
+	for i := 0; i < len(ops); i++ {
+		op := ops[i]
+		if op.OperationType == models.OperationTypeDelete && i+1 < len(ops) {
+			next := ops[i+1]
+			if next.OperationType == models.OperationTypeInsert && next.Pos == op.Pos && next.ID == op.ID {
+				op.OperationType = models.OperationTypeReplace
+				op.Content = next.Content
+				i++
+			}
+		}
+		result = append(result, op)
+	}
+
+	return result
+}
+
+/*
+transformLists transforms the sequence as against the concurrent sequence bs.
+It returns as rebased on top of bs, and bs rebased on top of as.
+*/
+func transformLists(as, bs []models.DocumentOperation) ([]models.DocumentOperation, []models.DocumentOperation) {
+	if len(as) == 0 || len(bs) == 0 {
+		return as, bs
+	}
+
+	if len(as) == 1 && len(bs) == 1 {
+		return transformPair(as[0], bs[0]), transformPair(bs[0], as[0])
+	}
+
+	// One at a time rather than halving, a long sequence is not copied at every level
+	if len(as) > 1 {
+		rebased := []models.DocumentOperation{}
+		for _, a := range as {
+			var first []models.DocumentOperation
+			first, bs = transformLists([]models.DocumentOperation{a}, bs)
+			rebased = append(rebased, first...)
+		}
+		return rebased, bs
+	}
+
+	asAfterFirst, first := transformLists(as, bs[:1])
+	asAfterRest, rest := transformLists(asAfterFirst, bs[1:])
+	return asAfterRest, append(first, rest...)
+}
+
+// transformPair rebases the insert or delete a on top of the concurrent insert or delete b
+func transformPair(a, b models.DocumentOperation) []models.DocumentOperation {
+	bInsertLen := utf8.RuneCountInString(b.Content)
+
+	switch {
+	case a.OperationType == models.OperationTypeInsert && b.OperationType == models.OperationTypeInsert:
+		if b.Pos < a.Pos || (b.Pos == a.Pos && insertsBefore(b, a)) {
+			a.Pos += bInsertLen
+		}
+
+	case a.OperationType == models.OperationTypeInsert && b.OperationType == models.OperationTypeDelete:
+		if b.Pos+b.DeleteLen <= a.Pos {
+			a.Pos -= b.DeleteLen
+		} else if b.Pos < a.Pos {
+			// The text around us is gone, insert where it used to start
+			a.Pos = b.Pos
+		}
+
+	case a.OperationType == models.OperationTypeDelete && b.OperationType == models.OperationTypeInsert:
+		if b.Pos <= a.Pos {
+			a.Pos += bInsertLen
+		} else if b.Pos < a.Pos+a.DeleteLen {
+			// Never delete what was inserted concurrently, delete around it instead
+			before := a
+			before.DeleteLen = b.Pos - a.Pos
+
+			after := a
+			after.Pos = a.Pos + bInsertLen
+			after.DeleteLen = a.DeleteLen - before.DeleteLen
+
+			return []models.DocumentOperation{before, after}
+		}
+
+	case a.OperationType == models.OperationTypeDelete && b.OperationType == models.OperationTypeDelete:
+		aEnd := a.Pos + a.DeleteLen
+		bEnd := b.Pos + b.DeleteLen
+
+		if aEnd <= b.Pos {
+			break
+		}
+		if bEnd <= a.Pos {
+			a.Pos -= b.DeleteLen
+			break
+		}
+
+		// Overlap, only delete what b has not deleted already
+		before := max(0, min(aEnd, b.Pos)-a.Pos)
+		after := max(0, aEnd-max(a.Pos, bEnd))
+		a.Pos = min(a.Pos, b.Pos)
+		a.DeleteLen = before + after
+		if a.DeleteLen == 0 {
+			return []models.DocumentOperation{}
+		}
+	}
+
+	return []models.DocumentOperation{a}
+}
+
+// insertsBefore breaks ties between two inserts at the same position
+func insertsBefore(a, b models.DocumentOperation) bool {
+	if a.UserID != b.UserID {
+		return a.UserID.String() < b.UserID.String()
+	}
+	return a.ID.String() < b.ID.String()
+}
@@ -0,0 +1,168 @@
+package services
+
+import (
+	"go-docs/cmd/models"
+	"go-docs/cmd/rope"
+	"go-docs/cmd/utils"
+	"math/rand"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+var (
+	userA = uuid.MustParse("00000000-0000-0000-0000-00000000000a")
+	userB = uuid.MustParse("00000000-0000-0000-0000-00000000000b")
+)
+
+func insertOp(user uuid.UUID, pos int, content string) models.DocumentOperation {
+	return models.DocumentOperation{ID: uuid.New(), UserID: user, OperationType: models.OperationTypeInsert, Pos: pos, Content: content}
+}
+
+func deleteOp(user uuid.UUID, pos, length int) models.DocumentOperation {
+	return models.DocumentOperation{ID: uuid.New(), UserID: user, OperationType: models.OperationTypeDelete, Pos: pos, DeleteLen: length}
+}
+
+func replaceOp(user uuid.UUID, pos, length int, content string) models.DocumentOperation {
+	return models.DocumentOperation{ID: uuid.New(), UserID: user, OperationType: models.OperationTypeReplace, Pos: pos, DeleteLen: length, Content: content}
+}
+
+func applyAll(t *testing.T, content string, ops []models.DocumentOperation) string {
+	t.Helper()
+
+	doc := rope.New(content)
+	for _, op := range ops {
+		var err error
+		if doc, err = utils.ApplyOperation(doc, op); err != nil {
+			t.Fatalf("applying %+v to %q: %v", op, doc.String(), err)
+		}
+	}
+	return doc.String()
+}
+
+// converge applies a then b rebased on it, and b then a rebased on it, both must give want
+func converge(t *testing.T, doc string, a, b models.DocumentOperation, want string) {
+	t.Helper()
+
+	as, bs := decompose(a), decompose(b)
+	asOnB, bsOnA := transformLists(as, bs)
+
+	left := applyAll(t, applyAll(t, doc, as), compose(bsOnA))
+	right := applyAll(t, applyAll(t, doc, bs), compose(asOnB))
+	if left != right {
+		t.Fatalf("diverged on %q: a then b gives %q, b then a gives %q", doc, left, right)
+	}
+	if left != want {
+		t.Errorf("converged on %q, want %q", left, want)
+	}
+}
+
+func TestTransformConverges(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		a, b models.DocumentOperation
+		want string
+	}{
+		{"insert insert tie, lower user first", "ab", insertOp(userA, 1, "x"), insertOp(userB, 1, "y"), "axyb"},
+		{"insert insert tie, either order", "ab", insertOp(userB, 1, "y"), insertOp(userA, 1, "x"), "axyb"},
+		{"insert insert apart", "abc", insertOp(userA, 0, "x"), insertOp(userB, 3, "y"), "xabcy"},
+		{"insert insert astral", "a😀b", insertOp(userA, 2, "😀"), insertOp(userB, 2, "x"), "a😀😀xb"},
+		{"delete delete same", "abcdef", deleteOp(userA, 1, 3), deleteOp(userB, 1, 3), "aef"},
+		{"delete delete overlap", "abcdef", deleteOp(userA, 1, 3), deleteOp(userB, 2, 3), "af"},
+		{"delete delete contained", "abcdef", deleteOp(userA, 0, 6), deleteOp(userB, 2, 2), ""},
+		{"delete delete apart", "abcdef", deleteOp(userA, 0, 1), deleteOp(userB, 4, 2), "bcd"},
+		{"insert inside delete", "abcdef", insertOp(userA, 3, "X"), deleteOp(userB, 1, 4), "aXf"},
+		{"insert at delete start", "abcdef", insertOp(userA, 1, "X"), deleteOp(userB, 1, 4), "aXf"},
+		{"insert at delete end", "abcdef", insertOp(userA, 5, "X"), deleteOp(userB, 1, 4), "aXf"},
+		{"replace replace overlap", "abcdef", replaceOp(userA, 1, 2, "X"), replaceOp(userB, 2, 2, "Y"), "aXYef"},
+		{"replace around insert", "abcdef", replaceOp(userA, 1, 4, "X"), insertOp(userB, 3, "Y"), "aXYf"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			converge(t, tt.doc, tt.a, tt.b, tt.want)
+		})
+	}
+}
+
+func TestInsertsBeforeBreaksTiesByOperationID(t *testing.T) {
+	a := insertOp(userA, 0, "x")
+	b := insertOp(userA, 0, "y")
+	a.ID = uuid.MustParse("00000000-0000-0000-0000-000000000001")
+	b.ID = uuid.MustParse("00000000-0000-0000-0000-000000000002")
+
+	if !insertsBefore(a, b) || insertsBefore(b, a) {
+		t.Errorf("same user inserts are not ordered by operation ID")
+	}
+	converge(t, "", a, b, "xy")
+	converge(t, "", b, a, "xy")
+}
+
+func TestDeleteSplitAroundConcurrentInsert(t *testing.T) {
+	got := transformPair(deleteOp(userA, 0, 4), insertOp(userB, 2, "X"))
+	if len(got) != 2 {
+		t.Fatalf("got %d operations, want the delete split in 2", len(got))
+	}
+	if got[0].Pos != 0 || got[0].DeleteLen != 2 || got[1].Pos != 1 || got[1].DeleteLen != 2 {
+		t.Errorf("got deletes at %d+%d and %d+%d, want 0+2 and 1+2", got[0].Pos, got[0].DeleteLen, got[1].Pos, got[1].DeleteLen)
+	}
+}
+
+func TestDeleteAlreadyDeletedIsDropped(t *testing.T) {
+	if got := transformPair(deleteOp(userA, 2, 2), deleteOp(userB, 1, 4)); len(got) != 0 {
+		t.Errorf("got %+v, want nothing left to delete", got)
+	}
+}
+
+var randomAlphabet = []rune("ab😀é")
+
+func randomText(r *rand.Rand) string {
+	text := make([]rune, 1+r.Intn(3))
+	for i := range text {
+		text[i] = randomAlphabet[r.Intn(len(randomAlphabet))]
+	}
+	return string(text)
+}
+
+func randomOp(r *rand.Rand, user uuid.UUID, length int) models.DocumentOperation {
+	pos := r.Intn(length + 1)
+	switch {
+	case pos == length || r.Intn(3) == 0:
+		return insertOp(user, pos, randomText(r))
+	case r.Intn(2) == 0:
+		return deleteOp(user, pos, 1+r.Intn(length-pos))
+	default:
+		return replaceOp(user, pos, 1+r.Intn(length-pos), randomText(r))
+	}
+}
+
+// TP1: apply(apply(doc, a), T(b, a)) == apply(apply(doc, b), T(a, b)) for random concurrent sequences
+func TestTransformListsTP1(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 5000; i++ {
+		doc := randomText(r) + randomText(r)
+		length := len([]rune(doc))
+
+		as, bs := []models.DocumentOperation{}, []models.DocumentOperation{}
+		aDoc, bDoc := doc, doc
+		for n := r.Intn(3) + 1; n > 0; n-- {
+			op := randomOp(r, userA, len([]rune(aDoc)))
+			as = append(as, decompose(op)...)
+			aDoc = applyAll(t, aDoc, decompose(op))
+		}
+		for n := r.Intn(3) + 1; n > 0; n-- {
+			op := randomOp(r, userB, len([]rune(bDoc)))
+			bs = append(bs, decompose(op)...)
+			bDoc = applyAll(t, bDoc, decompose(op))
+		}
+
+		asOnB, bsOnA := transformLists(as, bs)
+		left := applyAll(t, aDoc, bsOnA)
+		right := applyAll(t, bDoc, asOnB)
+		if left != right {
+			t.Fatalf("doc %q (%d runes), a %+v, b %+v: a then b gives %q, b then a gives %q", doc, length, as, bs, left, right)
+		}
+	}
+}
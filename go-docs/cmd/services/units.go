@@ -0,0 +1,66 @@
+package services
+
+import (
+	"go-docs/cmd/models"
+	"go-docs/cmd/rope"
+	"go-docs/cmd/utils"
+)
+
+// contentsAround rebuilds the document before each of ops and after the last
+// one, content being the document once they are all applied.
+func contentsAround(content *rope.Rope, ops []models.DocumentOperation) ([]*rope.Rope, error) {
+	contents := make([]*rope.Rope, len(ops)+1)
+	contents[len(ops)] = content
+
+	for i := len(ops) - 1; i >= 0; i-- {
+		reverted, err := utils.RevertOperation(contents[i+1], ops[i])
+		if err != nil {
+			return nil, err
+		}
+		contents[i] = reverted
+	}
+
+	return contents, nil
+}
+
+/*
+operationToRunes converts the positions of op, counted in unit by the client,
+into runes. They refer to the document at op.BaseVersion, which is the current
+one with newerVersions undone.
+*/
+func operationToRunes(content *rope.Rope, op models.DocumentOperation, newerVersions []models.DocumentOperation, unit utils.PositionUnit) (models.DocumentOperation, error) {
+	if unit == utils.PositionUnitRune {
+		return op, nil
+	}
+
+	contents, err := contentsAround(content, newerVersions)
+	if err != nil {
+		return op, err
+	}
+
+	return utils.ConvertOperation(contents[0], op, unit, utils.PositionUnitRune)
+}
+
+// resyncIn converts the operations a resync hands back into unit, falling back
+// to the snapshot when they cannot be replayed. The cache lock must be held.
+func resyncIn(resync *ResyncRequiredError, cache *models.OperationCache, unit utils.PositionUnit) *ResyncRequiredError {
+	if unit == utils.PositionUnitRune || resync.Operations == nil {
+		return resync
+	}
+
+	contents, err := contentsAround(cache.Content, resync.Operations)
+	if err == nil {
+		converted := make([]models.DocumentOperation, len(resync.Operations))
+		for i, op := range resync.Operations {
+			if converted[i], err = utils.ConvertOperation(contents[i], op, utils.PositionUnitRune, unit); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			return &ResyncRequiredError{BaseVersion: resync.BaseVersion, Version: resync.Version, Operations: converted}
+		}
+	}
+
+	snapshot := cache.Snapshot()
+	return &ResyncRequiredError{BaseVersion: resync.BaseVersion, Version: resync.Version, Document: &snapshot}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"go-docs/cmd/server"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+func shutdownTimeout() time.Duration {
+	if timeout, err := time.ParseDuration(os.Getenv("SHUTDOWN_TIMEOUT")); err == nil && timeout > 0 {
+		return timeout
+	}
+	return 20 * time.Second
+}
+
+/*
+Shutdown order, all within SHUTDOWN_TIMEOUT:
+1. Stop accepting connections and let in flight REST requests finish
+2. Close every socket with a reconnect hint
+3. Stop the background workers
+4. Run a final flush and report the documents it could not save
+5. Close redis and postgres
+*/
+func shutdown(httpServer *http.Server, rest *server.RestServer, db *gorm.DB, redis *redis.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout())
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		if err := httpServer.Shutdown(ctx); err != nil {
+			log.Printf("Failed to stop the REST server cleanly: %v", err)
+		}
+
+		failed := rest.Shutdown(ctx)
+		for _, documentID := range failed {
+			log.Printf("Document %s was not saved to the DB, its latest content is still in redis", documentID)
+		}
+	}()
+
+	select {
+	case <-done:
+		log.Println("Drained sockets and flushed documents")
+	case <-ctx.Done():
+		log.Println("Shutdown deadline exceeded, some documents may not be saved")
+	}
+
+	if err := redis.Close(); err != nil {
+		log.Printf("Failed to close redis: %v", err)
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		log.Printf("Failed to get database instance: %v", err)
+		return
+	}
+	if err := sqlDB.Close(); err != nil {
+		log.Printf("Failed to close database: %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"go-docs/cmd/models"
+	"unicode/utf8"
+)
+
+/*
+ApplyBlame moves the authorship spans along with an operation already applied
+to the content they describe:
+1. The spans before op.Pos and after the deleted range are kept as they are
+2. The inserted text goes to op.UserID at op.Version
+Neighbouring spans of the same user are merged, keeping the newest version as
+the last one touching them, so typing a paragraph leaves one span and not one
+per keystroke.
+*/
+func ApplyBlame(spans []models.BlameSpan, op models.DocumentOperation) []models.BlameSpan {
+	deleteLen := op.DeleteLen
+	if op.OperationType == models.OperationTypeInsert {
+		deleteLen = 0
+	}
+
+	blame := make([]models.BlameSpan, 0, len(spans)+2)
+	blame = appendBlameRange(blame, spans, 0, op.Pos)
+	blame = appendBlameSpan(blame, models.BlameSpan{Length: utf8.RuneCountInString(op.Content), UserID: op.UserID, Version: op.Version})
+	blame = appendBlameRange(blame, spans, op.Pos+deleteLen, -1)
+
+	return blame
+}
+
+// BlameLength is the length of the content spans describe
+func BlameLength(spans []models.BlameSpan) int {
+	length := 0
+	for _, span := range spans {
+		length += span.Length
+	}
+	return length
+}
+
+// appendBlameRange appends the spans covering [start, end), end -1 being the end of the content
+func appendBlameRange(blame, spans []models.BlameSpan, start, end int) []models.BlameSpan {
+	pos := 0
+	for _, span := range spans {
+		spanStart, spanEnd := pos, pos+span.Length
+		pos = spanEnd
+
+		if end != -1 && spanStart >= end {
+			break
+		}
+		if spanEnd <= start {
+			continue
+		}
+
+		from, to := max(spanStart, start), spanEnd
+		if end != -1 {
+			to = min(to, end)
+		}
+		span.Length = to - from
+		blame = appendBlameSpan(blame, span)
+	}
+	return blame
+}
+
+func appendBlameSpan(blame []models.BlameSpan, span models.BlameSpan) []models.BlameSpan {
+	if span.Length == 0 {
+		return blame
+	}
+
+	if last := len(blame) - 1; last >= 0 && blame[last].UserID == span.UserID {
+		blame[last].Length += span.Length
+		blame[last].Version = max(blame[last].Version, span.Version)
+		return blame
+	}
+
+	return append(blame, span)
+}
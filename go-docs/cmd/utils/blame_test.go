@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"go-docs/cmd/models"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func blameInsert(user uuid.UUID, version, pos int, content string) models.DocumentOperation {
+	return models.DocumentOperation{OperationType: models.OperationTypeInsert, UserID: user, Version: version, Pos: pos, Content: content}
+}
+
+func TestApplyBlameMergesTyping(t *testing.T) {
+	alice := uuid.New()
+
+	var spans []models.BlameSpan
+	for i, r := range "hello world" {
+		spans = ApplyBlame(spans, blameInsert(alice, i+1, i, string(r)))
+	}
+
+	want := []models.BlameSpan{{Length: 11, UserID: alice, Version: 11}}
+	if !reflect.DeepEqual(spans, want) {
+		t.Fatalf("spans = %+v, want one span at the last version %+v", spans, want)
+	}
+}
+
+func TestApplyBlameKeepsAuthors(t *testing.T) {
+	alice, bob := uuid.New(), uuid.New()
+
+	spans := ApplyBlame(nil, blameInsert(alice, 1, 0, "ab"))
+	spans = ApplyBlame(spans, blameInsert(alice, 2, 2, "cd"))
+	spans = ApplyBlame(spans, blameInsert(bob, 3, 1, "X"))
+
+	want := []models.BlameSpan{
+		{Length: 1, UserID: alice, Version: 2},
+		{Length: 1, UserID: bob, Version: 3},
+		{Length: 3, UserID: alice, Version: 2},
+	}
+	if !reflect.DeepEqual(spans, want) {
+		t.Fatalf("spans = %+v, want %+v", spans, want)
+	}
+
+	// Deleting bob's text brings alice's spans back together
+	spans = ApplyBlame(spans, models.DocumentOperation{OperationType: models.OperationTypeDelete, UserID: bob, Version: 4, Pos: 1, DeleteLen: 1})
+	want = []models.BlameSpan{{Length: 4, UserID: alice, Version: 2}}
+	if !reflect.DeepEqual(spans, want) {
+		t.Fatalf("spans after delete = %+v, want %+v", spans, want)
+	}
+	if BlameLength(spans) != 4 {
+		t.Errorf("BlameLength = %d, want 4", BlameLength(spans))
+	}
+}
@@ -0,0 +1,174 @@
+package utils
+
+type DiffKind string
+
+const (
+	DiffEqual  DiffKind = "equal"
+	DiffInsert DiffKind = "insert"
+	DiffDelete DiffKind = "delete"
+)
+
+// DiffSpan is a run of tokens [AStart, AEnd) of a and [BStart, BEnd) of b. An
+// insert has an empty range in a, a delete an empty range in b.
+type DiffSpan struct {
+	Kind   DiffKind
+	AStart int
+	AEnd   int
+	BStart int
+	BEnd   int
+}
+
+/*
+Diff returns the shortest edit script turning a into b, as spans in order.
+It is Myers' O((N+M)D) algorithm in linear space: find the middle snake of
+the edit graph, then diff both halves on their own. Common prefixes and
+suffixes are stripped first, they are most of a document.
+*/
+func Diff[T comparable](a, b []T) []DiffSpan {
+	d := differ[T]{a: a, b: b, spans: []DiffSpan{}}
+	d.diff(0, len(a), 0, len(b))
+	return d.spans
+}
+
+type differ[T comparable] struct {
+	a, b  []T
+	spans []DiffSpan
+}
+
+func (d *differ[T]) diff(aStart, aEnd, bStart, bEnd int) {
+	prefix := 0
+	for aStart+prefix < aEnd && bStart+prefix < bEnd && d.a[aStart+prefix] == d.b[bStart+prefix] {
+		prefix++
+	}
+	d.emit(DiffEqual, aStart, aStart+prefix, bStart, bStart+prefix)
+	aStart += prefix
+	bStart += prefix
+
+	suffix := 0
+	for aStart < aEnd-suffix && bStart < bEnd-suffix && d.a[aEnd-suffix-1] == d.b[bEnd-suffix-1] {
+		suffix++
+	}
+	aEnd -= suffix
+	bEnd -= suffix
+
+	switch {
+	case aStart == aEnd:
+		d.emit(DiffInsert, aStart, aStart, bStart, bEnd)
+	case bStart == bEnd:
+		d.emit(DiffDelete, aStart, aEnd, bStart, bStart)
+	default:
+		x, y, ok := d.middleSnake(aStart, aEnd, bStart, bEnd)
+		if !ok || (x == aStart && y == bStart) || (x == aEnd && y == bEnd) {
+			// Nothing in common
+			d.emit(DiffDelete, aStart, aEnd, bStart, bStart)
+			d.emit(DiffInsert, aEnd, aEnd, bStart, bEnd)
+		} else {
+			d.diff(aStart, x, bStart, y)
+			d.diff(x, aEnd, y, bEnd)
+		}
+	}
+
+	d.emit(DiffEqual, aEnd, aEnd+suffix, bEnd, bEnd+suffix)
+}
+
+// middleSnake walks the edit graph from both ends until the paths meet and returns where
+func (d *differ[T]) middleSnake(aStart, aEnd, bStart, bEnd int) (int, int, bool) {
+	a, b := d.a[aStart:aEnd], d.b[bStart:bEnd]
+	n, m := len(a), len(b)
+
+	maxD := (n + m + 1) / 2
+	offset := maxD
+	length := 2*maxD + 2
+	forward := make([]int, length)
+	backward := make([]int, length)
+	for i := range forward {
+		forward[i] = -1
+		backward[i] = -1
+	}
+	forward[offset+1] = 0
+	backward[offset+1] = 0
+
+	delta := n - m
+	// With an odd delta the forward path is the one that meets the other
+	front := delta%2 != 0
+	kForwardStart, kForwardEnd, kBackwardStart, kBackwardEnd := 0, 0, 0, 0
+
+	for step := 0; step < maxD; step++ {
+		for k := -step + kForwardStart; k <= step-kForwardEnd; k += 2 {
+			index := offset + k
+			var x int
+			if k == -step || (k != step && forward[index-1] < forward[index+1]) {
+				x = forward[index+1]
+			} else {
+				x = forward[index-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[index] = x
+
+			if x > n {
+				kForwardEnd += 2
+			} else if y > m {
+				kForwardStart += 2
+			} else if front {
+				backwardIndex := offset + delta - k
+				if backwardIndex >= 0 && backwardIndex < length && backward[backwardIndex] != -1 {
+					if x >= n-backward[backwardIndex] {
+						return aStart + x, bStart + y, true
+					}
+				}
+			}
+		}
+
+		for k := -step + kBackwardStart; k <= step-kBackwardEnd; k += 2 {
+			index := offset + k
+			var x int
+			if k == -step || (k != step && backward[index-1] < backward[index+1]) {
+				x = backward[index+1]
+			} else {
+				x = backward[index-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-x-1] == b[m-y-1] {
+				x++
+				y++
+			}
+			backward[index] = x
+
+			if x > n {
+				kBackwardEnd += 2
+			} else if y > m {
+				kBackwardStart += 2
+			} else if !front {
+				forwardIndex := offset + delta - k
+				if forwardIndex >= 0 && forwardIndex < length && forward[forwardIndex] != -1 {
+					forwardX := forward[forwardIndex]
+					forwardY := offset + forwardX - forwardIndex
+					if forwardX >= n-x {
+						return aStart + forwardX, bStart + forwardY, true
+					}
+				}
+			}
+		}
+	}
+
+	return 0, 0, false
+}
+
+// emit appends a span, merging it into the previous one when they continue each other
+func (d *differ[T]) emit(kind DiffKind, aStart, aEnd, bStart, bEnd int) {
+	if aStart == aEnd && bStart == bEnd {
+		return
+	}
+
+	if last := len(d.spans) - 1; last >= 0 && d.spans[last].Kind == kind && d.spans[last].AEnd == aStart && d.spans[last].BEnd == bStart {
+		d.spans[last].AEnd = aEnd
+		d.spans[last].BEnd = bEnd
+		return
+	}
+
+	d.spans = append(d.spans, DiffSpan{Kind: kind, AStart: aStart, AEnd: aEnd, BStart: bStart, BEnd: bEnd})
+}
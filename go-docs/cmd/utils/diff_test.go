@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// lcsLength is the textbook dynamic program, the reference for a minimal script
+func lcsLength[T comparable](a, b []T) int {
+	previous, current := make([]int, len(b)+1), make([]int, len(b)+1)
+	for i := range a {
+		for j := range b {
+			if a[i] == b[j] {
+				current[j+1] = previous[j] + 1
+			} else {
+				current[j+1] = max(previous[j+1], current[j])
+			}
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// checkDiff checks the spans cover both sides in order, rebuild both and edit as little as possible
+func checkDiff[T comparable](t *testing.T, a, b []T) []DiffSpan {
+	t.Helper()
+
+	spans := Diff(a, b)
+	fromA, toB := []T{}, []T{}
+	aPos, bPos, edits := 0, 0, 0
+	for i, span := range spans {
+		if span.AStart != aPos || span.BStart != bPos {
+			t.Fatalf("span %d %+v does not start where the previous one ended (%d, %d)", i, span, aPos, bPos)
+		}
+		switch span.Kind {
+		case DiffEqual:
+			if !slices.Equal(a[span.AStart:span.AEnd], b[span.BStart:span.BEnd]) {
+				t.Fatalf("equal span %d %+v covers different tokens", i, span)
+			}
+			fromA = append(fromA, a[span.AStart:span.AEnd]...)
+			toB = append(toB, b[span.BStart:span.BEnd]...)
+		case DiffDelete:
+			if span.BStart != span.BEnd {
+				t.Fatalf("delete span %d %+v covers tokens of b", i, span)
+			}
+			fromA = append(fromA, a[span.AStart:span.AEnd]...)
+			edits += span.AEnd - span.AStart
+		case DiffInsert:
+			if span.AStart != span.AEnd {
+				t.Fatalf("insert span %d %+v covers tokens of a", i, span)
+			}
+			toB = append(toB, b[span.BStart:span.BEnd]...)
+			edits += span.BEnd - span.BStart
+		}
+		aPos, bPos = span.AEnd, span.BEnd
+	}
+
+	if !slices.Equal(fromA, a) || !slices.Equal(toB, b) {
+		t.Fatalf("spans rebuild %v and %v, want %v and %v", fromA, toB, a, b)
+	}
+	if want := len(a) + len(b) - 2*lcsLength(a, b); edits != want {
+		t.Errorf("diff of %v and %v edits %d tokens, the shortest script edits %d", a, b, edits, want)
+	}
+	return spans
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name  string
+		a, b  string
+		spans int
+	}{
+		{"both empty", "", "", 0},
+		{"from empty", "", "abc", 1},
+		{"to empty", "abc", "", 1},
+		{"identical", "hello", "hello", 1},
+		{"prefix and suffix", "hello world", "hello there world", 3},
+		{"myers paper", "abcabba", "cbabac", -1},
+		{"nothing in common", "abc", "xyz", 2},
+		{"astral", "a😀b😃c", "a😃b😀c", -1},
+		{"combining", "café", "café", 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spans := checkDiff(t, []rune(tt.a), []rune(tt.b))
+			if tt.spans >= 0 && len(spans) != tt.spans {
+				t.Errorf("got %d spans %+v, want %d", len(spans), spans, tt.spans)
+			}
+		})
+	}
+}
+
+func TestDiffRandomIsMinimal(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	alphabet := []rune("ab😀")
+	random := func() []rune {
+		text := make([]rune, r.Intn(30))
+		for i := range text {
+			text[i] = alphabet[r.Intn(len(alphabet))]
+		}
+		return text
+	}
+
+	for i := 0; i < 2000; i++ {
+		checkDiff(t, random(), random())
+	}
+}
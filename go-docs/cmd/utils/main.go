@@ -3,13 +3,16 @@ package utils
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"go-docs/cmd/models"
+	"go-docs/cmd/rope"
 	"go-docs/cmd/server/dto"
 	"log"
 	"net/http"
 	"os"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
 func GetJWTSecret() []byte {
@@ -62,12 +65,114 @@ func GetErrorResponse(title, message string, w http.ResponseWriter, statusCode i
 	})
 }
 
-func UpdatedContent(content string, op models.DocumentOperation) string {
-	runes := []rune(content)
+// InvalidOperationError rejects an operation that cannot be applied as sent
+type InvalidOperationError struct {
+	OperationID string `json:"operation_id"`
+	Reason      string `json:"reason"`
+}
+
+func (e *InvalidOperationError) Error() string {
+	return "invalid operation: " + e.Reason
+}
+
+func invalidOperation(op models.DocumentOperation, format string, args ...any) error {
+	return &InvalidOperationError{OperationID: op.ID.String(), Reason: fmt.Sprintf(format, args...)}
+}
+
+// ValidateOperation checks everything about op that does not depend on the document content
+func ValidateOperation(op models.DocumentOperation) error {
+	if op.ID == uuid.Nil {
+		return invalidOperation(op, "id is required")
+	}
+	if op.Pos < 0 {
+		return invalidOperation(op, "pos %d is negative", op.Pos)
+	}
+	if op.DeleteLen < 0 {
+		return invalidOperation(op, "delete_len %d is negative", op.DeleteLen)
+	}
+	if op.BaseVersion < 0 {
+		return invalidOperation(op, "base_version %d is negative", op.BaseVersion)
+	}
+
+	switch op.OperationType {
+	case models.OperationTypeInsert:
+		if op.Content == "" {
+			return invalidOperation(op, "insert has no content")
+		}
+	case models.OperationTypeDelete:
+		if op.DeleteLen == 0 {
+			return invalidOperation(op, "delete has no delete_len")
+		}
+	case models.OperationTypeReplace:
+		if op.DeleteLen == 0 && op.Content == "" {
+			return invalidOperation(op, "replace has neither content nor delete_len")
+		}
+	default:
+		return invalidOperation(op, "unknown operation_type %q", op.OperationType)
+	}
+
+	return nil
+}
+
+// ApplyOperation applies op to content, or rejects it without touching anything when it does not fit
+func ApplyOperation(content *rope.Rope, op models.DocumentOperation) (*rope.Rope, error) {
+	if err := ValidateOperation(op); err != nil {
+		return content, err
+	}
+
+	length := content.Len()
+
+	if op.Pos > length {
+		return content, invalidOperation(op, "pos %d is past the end of the document (%d)", op.Pos, length)
+	}
 
 	if op.OperationType == models.OperationTypeInsert {
-		return string(runes[:op.Pos]) + op.Content + string(runes[op.Pos:])
-	} else {
-		return string(runes[:op.Pos]) + op.Content + string(runes[op.Pos+op.DeleteLen:])
+		return content.Insert(op.Pos, op.Content), nil
+	}
+
+	if op.Pos+op.DeleteLen > length {
+		return content, invalidOperation(op, "deleting %d from pos %d goes past the end of the document (%d)", op.DeleteLen, op.Pos, length)
+	}
+
+	return content.Delete(op.Pos, op.DeleteLen).Insert(op.Pos, op.Content), nil
+}
+
+// TransformRange moves [start, end) along with op. Text inserted right at the
+// end stays out of it, an empty range stays empty.
+func TransformRange(start, end int, op models.DocumentOperation) (int, int) {
+	newStart := TransformPosition(start, op)
+	if start == end {
+		return newStart, newStart
 	}
+	if op.OperationType == models.OperationTypeInsert && op.Pos == end {
+		return newStart, end
+	}
+	return newStart, max(newStart, TransformPosition(end, op))
+}
+
+// TransformPosition moves a position (cursor, selection bound) so it keeps
+// pointing at the same text after op has been applied.
+func TransformPosition(pos int, op models.DocumentOperation) int {
+	insertedLength := len([]rune(op.Content))
+
+	switch op.OperationType {
+	case models.OperationTypeInsert:
+		if op.Pos <= pos {
+			return pos + insertedLength
+		}
+	case models.OperationTypeDelete:
+		if op.Pos+op.DeleteLen <= pos {
+			return pos - op.DeleteLen
+		} else if op.Pos < pos {
+			return op.Pos
+		}
+	case models.OperationTypeReplace:
+		if op.Pos+op.DeleteLen <= pos {
+			return pos - op.DeleteLen + insertedLength
+		} else if op.Pos < pos {
+			return op.Pos + insertedLength
+		}
+	}
+
+	return pos
 }
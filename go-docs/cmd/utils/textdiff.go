@@ -0,0 +1,232 @@
+package utils
+
+import (
+	"fmt"
+	"go-docs/cmd/server/dto"
+	"html"
+	"strings"
+	"unicode"
+)
+
+/*
+Text diffs run Diff over tokens of the two contents:
+1. char, one grapheme cluster per token so an emoji is never cut in half
+2. word, runs of letters and digits, runs of spaces and every other character
+on its own
+3. line, what the unified format always uses
+Joined back together the tokens are the content again.
+*/
+type DiffGranularity string
+
+const (
+	DiffGranularityChar DiffGranularity = "char"
+	DiffGranularityWord DiffGranularity = "word"
+	DiffGranularityLine DiffGranularity = "line"
+)
+
+func ParseDiffGranularity(granularity string) (DiffGranularity, error) {
+	switch DiffGranularity(granularity) {
+	case "", DiffGranularityWord:
+		return DiffGranularityWord, nil
+	case DiffGranularityChar, DiffGranularityLine:
+		return DiffGranularity(granularity), nil
+	}
+	return "", fmt.Errorf("unknown diff granularity %q, expected char, word or line", granularity)
+}
+
+func Tokenize(text string, granularity DiffGranularity) []string {
+	runes := []rune(text)
+	tokens := []string{}
+
+	switch granularity {
+	case DiffGranularityLine:
+		tokens = strings.SplitAfter(text, "\n")
+		if tokens[len(tokens)-1] == "" {
+			tokens = tokens[:len(tokens)-1]
+		}
+
+	case DiffGranularityChar:
+		offsets := graphemeOffsets(runes)
+		start := 0
+		for i := 1; i <= len(runes); i++ {
+			if offsets[i] != -1 {
+				tokens = append(tokens, string(runes[start:i]))
+				start = i
+			}
+		}
+
+	default:
+		start := 0
+		for i := 1; i <= len(runes); i++ {
+			if i == len(runes) || wordClass(runes[i]) == 0 || wordClass(runes[i]) != wordClass(runes[i-1]) {
+				tokens = append(tokens, string(runes[start:i]))
+				start = i
+			}
+		}
+	}
+
+	return tokens
+}
+
+// wordClass groups runes into words: 1 for word characters, 2 for spaces, 0 for anything standing alone
+func wordClass(r rune) int {
+	switch {
+	case unicode.IsLetter(r), unicode.IsDigit(r), unicode.IsMark(r), r == '_', r == '\'':
+		return 1
+	case r == ' ', r == '\t':
+		return 2
+	}
+	return 0
+}
+
+// DiffHunks diffs a against b and keeps context unchanged tokens around every change
+func DiffHunks(a, b string, granularity DiffGranularity, context int) []dto.DiffHunk {
+	tokensA, tokensB := Tokenize(a, granularity), Tokenize(b, granularity)
+	offsetsA, offsetsB := runeOffsets(tokensA), runeOffsets(tokensB)
+
+	hunks := []dto.DiffHunk{}
+	for _, spans := range groupHunks(Diff(tokensA, tokensB), context) {
+		first, last := spans[0], spans[len(spans)-1]
+		hunk := dto.DiffHunk{
+			FromStart:  offsetsA[first.AStart],
+			FromLength: offsetsA[last.AEnd] - offsetsA[first.AStart],
+			ToStart:    offsetsB[first.BStart],
+			ToLength:   offsetsB[last.BEnd] - offsetsB[first.BStart],
+			Changes:    make([]dto.DiffChange, 0, len(spans)),
+		}
+		for _, span := range spans {
+			hunk.Changes = append(hunk.Changes, dto.DiffChange{Kind: string(span.Kind), Text: spanText(span, tokensA, tokensB)})
+		}
+		hunks = append(hunks, hunk)
+	}
+
+	return hunks
+}
+
+// UnifiedDiff renders a line diff of a against b like diff -u, empty when they are the same
+func UnifiedDiff(a, b, fromName, toName string, context int) string {
+	linesA, linesB := Tokenize(a, DiffGranularityLine), Tokenize(b, DiffGranularityLine)
+	hunks := groupHunks(Diff(linesA, linesB), context)
+	if len(hunks) == 0 {
+		return ""
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+	for _, spans := range hunks {
+		first, last := spans[0], spans[len(spans)-1]
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n",
+			unifiedRange(first.AStart, last.AEnd-first.AStart),
+			unifiedRange(first.BStart, last.BEnd-first.BStart),
+		)
+
+		for _, span := range spans {
+			prefix, lines := " ", linesA[span.AStart:span.AEnd]
+			switch span.Kind {
+			case DiffDelete:
+				prefix = "-"
+			case DiffInsert:
+				prefix, lines = "+", linesB[span.BStart:span.BEnd]
+			}
+
+			for _, line := range lines {
+				out.WriteString(prefix + line)
+				if !strings.HasSuffix(line, "\n") {
+					out.WriteString("\n\\ No newline at end of file\n")
+				}
+			}
+		}
+	}
+
+	return out.String()
+}
+
+// HTMLDiff renders b with what was removed from a in <del> and what was added in <ins>
+func HTMLDiff(a, b string, granularity DiffGranularity) string {
+	tokensA, tokensB := Tokenize(a, granularity), Tokenize(b, granularity)
+
+	var out strings.Builder
+	for _, span := range Diff(tokensA, tokensB) {
+		text := html.EscapeString(spanText(span, tokensA, tokensB))
+		switch span.Kind {
+		case DiffDelete:
+			out.WriteString("<del>" + text + "</del>")
+		case DiffInsert:
+			out.WriteString("<ins>" + text + "</ins>")
+		default:
+			out.WriteString(text)
+		}
+	}
+
+	return out.String()
+}
+
+/*
+groupHunks cuts the spans of a diff into hunks:
+1. Every change keeps up to context equal tokens before and after it
+2. Changes closer than 2*context tokens share a hunk
+*/
+func groupHunks(spans []DiffSpan, context int) [][]DiffSpan {
+	hunks := [][]DiffSpan{}
+
+	var hunk []DiffSpan
+	for i, span := range spans {
+		if span.Kind != DiffEqual {
+			if hunk == nil && i > 0 {
+				previous := spans[i-1]
+				if lead := min(context, previous.AEnd-previous.AStart); lead > 0 {
+					hunk = append(hunk, DiffSpan{Kind: DiffEqual, AStart: previous.AEnd - lead, AEnd: previous.AEnd, BStart: previous.BEnd - lead, BEnd: previous.BEnd})
+				}
+			}
+			hunk = append(hunk, span)
+			continue
+		}
+
+		if hunk == nil {
+			continue
+		}
+
+		length := span.AEnd - span.AStart
+		if i < len(spans)-1 && length <= 2*context {
+			hunk = append(hunk, span)
+			continue
+		}
+
+		if trail := min(context, length); trail > 0 {
+			hunk = append(hunk, DiffSpan{Kind: DiffEqual, AStart: span.AStart, AEnd: span.AStart + trail, BStart: span.BStart, BEnd: span.BStart + trail})
+		}
+		hunks = append(hunks, hunk)
+		hunk = nil
+	}
+	if hunk != nil {
+		hunks = append(hunks, hunk)
+	}
+
+	return hunks
+}
+
+func unifiedRange(start, length int) string {
+	switch length {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, length)
+}
+
+// runeOffsets returns the rune offset of every token, and the total length last
+func runeOffsets(tokens []string) []int {
+	offsets := make([]int, len(tokens)+1)
+	for i, token := range tokens {
+		offsets[i+1] = offsets[i] + len([]rune(token))
+	}
+	return offsets
+}
+
+func spanText(span DiffSpan, a, b []string) string {
+	if span.Kind == DiffInsert {
+		return strings.Join(b[span.BStart:span.BEnd], "")
+	}
+	return strings.Join(a[span.AStart:span.AEnd], "")
+}
@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text        string
+		granularity DiffGranularity
+		want        []string
+	}{
+		{"", DiffGranularityChar, []string{}},
+		{"", DiffGranularityLine, []string{}},
+		{"café👍🏽!", DiffGranularityChar, []string{"c", "a", "f", "é", "👍🏽", "!"}},
+		{"it's  a café, ok", DiffGranularityWord, []string{"it's", "  ", "a", " ", "café", ",", " ", "ok"}},
+		{"one\ntwo\n", DiffGranularityLine, []string{"one\n", "two\n"}},
+		{"one\ntwo", DiffGranularityLine, []string{"one\n", "two"}},
+	}
+
+	for _, tt := range tests {
+		got := Tokenize(tt.text, tt.granularity)
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+			t.Errorf("Tokenize(%q, %s) = %q, want %q", tt.text, tt.granularity, got, tt.want)
+		}
+		if strings.Join(got, "") != tt.text {
+			t.Errorf("tokens of %q join back into %q", tt.text, strings.Join(got, ""))
+		}
+	}
+}
+
+// rebuild replays hunks on a, the text between them being unchanged
+func rebuild(t *testing.T, a string, b string, granularity DiffGranularity) {
+	t.Helper()
+
+	runes := []rune(a)
+	var out strings.Builder
+	pos := 0
+	for _, hunk := range DiffHunks(a, b, granularity, 1) {
+		out.WriteString(string(runes[pos:hunk.FromStart]))
+		from := ""
+		for _, change := range hunk.Changes {
+			switch change.Kind {
+			case string(DiffEqual):
+				out.WriteString(change.Text)
+				from += change.Text
+			case string(DiffDelete):
+				from += change.Text
+			case string(DiffInsert):
+				out.WriteString(change.Text)
+			}
+		}
+		if want := string(runes[hunk.FromStart : hunk.FromStart+hunk.FromLength]); from != want {
+			t.Fatalf("hunk %+v covers %q of a, it says %q", hunk, want, from)
+		}
+		pos = hunk.FromStart + hunk.FromLength
+	}
+	out.WriteString(string(runes[pos:]))
+
+	if out.String() != b {
+		t.Errorf("%s hunks of %q and %q rebuild %q", granularity, a, b, out.String())
+	}
+}
+
+func TestDiffHunks(t *testing.T) {
+	tests := []struct{ a, b string }{
+		{"", ""},
+		{"", "hello"},
+		{"hello", ""},
+		{"same text", "same text"},
+		{"the quick brown fox", "the quick red fox jumps"},
+		{"a😀 b c d e f g h 😃i", "a😃 b c d e f g h 😀i"},
+		{"café au lait", "café au lait"},
+		{"one\ntwo\nthree\n", "one\n2\nthree\nfour"},
+	}
+
+	for _, tt := range tests {
+		for _, granularity := range []DiffGranularity{DiffGranularityChar, DiffGranularityWord, DiffGranularityLine} {
+			rebuild(t, tt.a, tt.b, granularity)
+		}
+	}
+
+	if hunks := DiffHunks("same text", "same text", DiffGranularityWord, 3); len(hunks) != 0 {
+		t.Errorf("identical texts gave hunks %+v", hunks)
+	}
+	if hunks := DiffHunks("x 1 2 3 4 5 6 7 8 y", "z 1 2 3 4 5 6 7 8 w", DiffGranularityWord, 1); len(hunks) != 2 {
+		t.Errorf("changes far apart gave %d hunks, want 2", len(hunks))
+	}
+}
+
+func TestDiffHunksCountRunes(t *testing.T) {
+	hunks := DiffHunks("😀😀a", "😀😀b", DiffGranularityChar, 0)
+	if len(hunks) != 1 || hunks[0].FromStart != 2 || hunks[0].FromLength != 1 || hunks[0].ToStart != 2 || hunks[0].ToLength != 1 {
+		t.Errorf("got %+v, want one hunk at rune 2", hunks)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	if got := UnifiedDiff("same\n", "same\n", "a", "b", 3); got != "" {
+		t.Errorf("identical texts gave %q", got)
+	}
+
+	got := UnifiedDiff("one\ntwo\nthree\n", "one\n2\nthree", "a", "b", 1)
+	want := "--- a\n+++ b\n@@ -1,3 +1,3 @@\n one\n-two\n-three\n+2\n+three\n\\ No newline at end of file\n"
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	got = UnifiedDiff("", "new\n", "a", "b", 3)
+	want = "--- a\n+++ b\n@@ -0,0 +1 @@\n+new\n"
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHTMLDiff(t *testing.T) {
+	tests := []struct{ a, b, want string }{
+		{"", "", ""},
+		{"same", "same", "same"},
+		{"a <b> c", "a <i> c", "a &lt;<del>b</del><ins>i</ins>&gt; c"},
+		{"a😀", "a😃", "a<del>😀</del><ins>😃</ins>"},
+	}
+
+	for _, tt := range tests {
+		if got := HTMLDiff(tt.a, tt.b, DiffGranularityWord); got != tt.want {
+			t.Errorf("HTMLDiff(%q, %q) = %q, want %q", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
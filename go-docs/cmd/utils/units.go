@@ -0,0 +1,233 @@
+package utils
+
+import (
+	"fmt"
+	"go-docs/cmd/models"
+	"go-docs/cmd/rope"
+	"unicode"
+	"unicode/utf8"
+)
+
+/*
+Positions are stored and transformed in runes. Browsers count in UTF-16 code
+units and editors move the caret by grapheme cluster, so each socket picks
+its unit and positions are converted at the edge.
+*/
+type PositionUnit string
+
+const (
+	PositionUnitRune     PositionUnit = "rune"
+	PositionUnitUTF16    PositionUnit = "utf16"
+	PositionUnitGrapheme PositionUnit = "grapheme"
+)
+
+func ParsePositionUnit(unit string) (PositionUnit, error) {
+	switch PositionUnit(unit) {
+	case "", PositionUnitRune:
+		return PositionUnitRune, nil
+	case PositionUnitUTF16, PositionUnitGrapheme:
+		return PositionUnit(unit), nil
+	}
+	return "", fmt.Errorf("unknown position unit %q, expected rune, utf16 or grapheme", unit)
+}
+
+// graphemeOffsets returns, for every rune offset, the offset in grapheme
+// clusters. -1 marks rune offsets that fall inside a cluster.
+func graphemeOffsets(runes []rune) []int {
+	offsets := make([]int, len(runes)+1)
+
+	clusters := 0
+	for i := range runes {
+		if i > 0 && !isGraphemeBreak(runes, i) {
+			offsets[i] = -1
+			continue
+		}
+		offsets[i] = clusters
+		clusters++
+	}
+	offsets[len(runes)] = clusters
+
+	return offsets
+}
+
+/*
+isGraphemeBreak tells whether a cluster starts at runes[i]. It follows the
+common rules of UAX #29: CR LF, combining marks, variation selectors, emoji
+modifiers, zero width joiner sequences and regional indicator pairs.
+*/
+func isGraphemeBreak(runes []rune, i int) bool {
+	prev, current := runes[i-1], runes[i]
+
+	switch {
+	case prev == '\r' && current == '\n':
+		return false
+	case unicode.In(current, unicode.Mn, unicode.Me, unicode.Mc):
+		return false
+	case current == 0x200D: // Zero width joiner
+		return false
+	case prev == 0x200D && i >= 2 && !unicode.IsSpace(runes[i-2]):
+		return false
+	case current >= 0xFE00 && current <= 0xFE0F, current >= 0xE0100 && current <= 0xE01EF:
+		return false
+	case current >= 0x1F3FB && current <= 0x1F3FF: // Emoji skin tone modifiers
+		return false
+	case current >= 0xE0020 && current <= 0xE007F: // Emoji tag sequences
+		return false
+	case isRegionalIndicator(current) && isRegionalIndicator(prev):
+		// Flags are pairs, break before an odd indicator only
+		count := 0
+		for j := i - 1; j >= 0 && isRegionalIndicator(runes[j]); j-- {
+			count++
+		}
+		return count%2 == 0
+	}
+
+	return true
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+/*
+ToRuneOffset converts an offset counted in unit into runes. UTF-16 offsets are
+resolved on the rope in O(log n), grapheme clusters are counted from the start
+of the document up to the offset, never over the whole text.
+*/
+func ToRuneOffset(content *rope.Rope, offset int, unit PositionUnit) (int, bool) {
+	switch unit {
+	case PositionUnitUTF16:
+		return content.UTF16ToRune(offset)
+	case PositionUnitGrapheme:
+		if offset < 0 {
+			return 0, false
+		}
+		// A cluster is one rune or more, it starts at a rune offset at least as
+		// large. Look at longer and longer prefixes until one reaches it.
+		for length := offset + 64; ; length *= 2 {
+			complete := length >= content.Len()
+			runes := []rune(content.Slice(0, min(length, content.Len())))
+			offsets := graphemeOffsets(runes)
+
+			// The end of a prefix is not a boundary unless it is the end of the document
+			last := len(runes)
+			if !complete {
+				last--
+			}
+			for runeOffset := 0; runeOffset <= last; runeOffset++ {
+				if offsets[runeOffset] == offset {
+					return runeOffset, true
+				} else if offsets[runeOffset] > offset {
+					return 0, false
+				}
+			}
+			if complete {
+				return 0, false
+			}
+		}
+	}
+	return offset, offset >= 0 && offset <= content.Len()
+}
+
+// FromRuneOffset converts a rune offset into unit, rounding down inside a grapheme cluster
+func FromRuneOffset(content *rope.Rope, runeOffset int, unit PositionUnit) int {
+	switch unit {
+	case PositionUnitUTF16:
+		return content.RuneToUTF16(runeOffset)
+	case PositionUnitGrapheme:
+		runeOffset = min(max(runeOffset, 0), content.Len())
+		// Whether a cluster starts at runeOffset depends on the runes up to it only
+		offsets := graphemeOffsets([]rune(content.Slice(0, min(runeOffset+1, content.Len()))))
+		for offsets[runeOffset] < 0 {
+			runeOffset--
+		}
+		return offsets[runeOffset]
+	}
+	return runeOffset
+}
+
+// FromRuneOffsets is FromRuneOffset for many offsets, segmenting the text once
+func FromRuneOffsets(content *rope.Rope, runeOffsets []int, unit PositionUnit) []int {
+	converted := make([]int, len(runeOffsets))
+	if unit != PositionUnitGrapheme {
+		for i, runeOffset := range runeOffsets {
+			converted[i] = FromRuneOffset(content, runeOffset, unit)
+		}
+		return converted
+	}
+
+	offsets := graphemeOffsets(content.Runes())
+	for i, runeOffset := range runeOffsets {
+		runeOffset = min(max(runeOffset, 0), len(offsets)-1)
+		for offsets[runeOffset] < 0 {
+			runeOffset--
+		}
+		converted[i] = offsets[runeOffset]
+	}
+	return converted
+}
+
+/*
+ConvertOperation rewrites Pos and DeleteLen of op from one unit to another.
+content is the document op applies to. An offset that does not exist in the
+source unit, past the end or in the middle of a surrogate pair or a
+cluster, makes the operation invalid.
+*/
+func ConvertOperation(content *rope.Rope, op models.DocumentOperation, from, to PositionUnit) (models.DocumentOperation, error) {
+	if from == to {
+		return op, nil
+	}
+
+	start, end := op.Pos, op.Pos+op.DeleteLen
+
+	if from != PositionUnitRune {
+		var ok bool
+		if start, ok = ToRuneOffset(content, start, from); !ok {
+			return op, invalidOperation(op, "pos %d is not a %s boundary of the document", op.Pos, from)
+		}
+		if end, ok = ToRuneOffset(content, end, from); !ok {
+			return op, invalidOperation(op, "pos %d + delete_len %d is not a %s boundary of the document", op.Pos, op.DeleteLen, from)
+		}
+	}
+
+	if to != PositionUnitRune {
+		start = FromRuneOffset(content, start, to)
+		end = FromRuneOffset(content, end, to)
+	}
+
+	op.Pos = start
+	op.DeleteLen = end - start
+	return op, nil
+}
+
+// ConvertSuggestion counts the anchor of a suggestion in unit, content being the document at its version
+func ConvertSuggestion(content *rope.Rope, suggestion models.DocumentSuggestion, unit PositionUnit) models.DocumentSuggestion {
+	if unit == PositionUnitRune || suggestion.Pos+suggestion.DeleteLen > content.Len() {
+		return suggestion
+	}
+
+	start := FromRuneOffset(content, suggestion.Pos, unit)
+	end := FromRuneOffset(content, suggestion.Pos+suggestion.DeleteLen, unit)
+	suggestion.Pos = start
+	suggestion.DeleteLen = end - start
+	return suggestion
+}
+
+// DeletedContent returns the text op removes from content, op must be valid for content
+func DeletedContent(content *rope.Rope, op models.DocumentOperation) string {
+	if op.OperationType == models.OperationTypeInsert {
+		return ""
+	}
+	return content.Slice(op.Pos, op.Pos+op.DeleteLen)
+}
+
+// RevertOperation undoes op on the content it produced, using the text it deleted
+func RevertOperation(content *rope.Rope, op models.DocumentOperation) (*rope.Rope, error) {
+	insertedLength := utf8.RuneCountInString(op.Content)
+
+	if op.Pos < 0 || op.Pos+insertedLength > content.Len() {
+		return content, invalidOperation(op, "cannot be reverted on a document of length %d", content.Len())
+	}
+
+	return content.Delete(op.Pos, insertedLength).Insert(op.Pos, op.Deleted), nil
+}
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"go-docs/cmd/rope"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// Walking a prefix must give what segmenting the whole text gives
+func TestGraphemeOffsetsMatchWholeText(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	pieces := []string{"a", "é", "é", "😀", "👍🏽", "👨‍👩‍👧", "🇫🇷", "🇩🇪", "\r\n", " ", "❤️"}
+
+	for i := 0; i < 100; i++ {
+		var text strings.Builder
+		for n := r.Intn(150); n > 0; n-- {
+			text.WriteString(pieces[r.Intn(len(pieces))])
+		}
+		content := rope.New(text.String())
+		offsets := graphemeOffsets(content.Runes())
+
+		for runeOffset, clusterOffset := range offsets {
+			if clusterOffset >= 0 {
+				if got, ok := ToRuneOffset(content, clusterOffset, PositionUnitGrapheme); !ok || got != runeOffset {
+					t.Fatalf("ToRuneOffset(%q, %d) = %d, %v, want %d", text.String(), clusterOffset, got, ok, runeOffset)
+				}
+			}
+
+			want := clusterOffset
+			for back := runeOffset; want < 0; back-- {
+				want = offsets[back-1]
+			}
+			if got := FromRuneOffset(content, runeOffset, PositionUnitGrapheme); got != want {
+				t.Fatalf("FromRuneOffset(%q, %d) = %d, want %d", text.String(), runeOffset, got, want)
+			}
+		}
+
+		if _, ok := ToRuneOffset(content, offsets[len(offsets)-1]+1, PositionUnitGrapheme); ok {
+			t.Fatalf("ToRuneOffset accepted a cluster offset past the end of %q", text.String())
+		}
+	}
+}
+
+func TestFromRuneOffsets(t *testing.T) {
+	content := rope.New("a👍🏽éb")
+	got := FromRuneOffsets(content, []int{0, 1, 2, 3, 4, 5, 6}, PositionUnitGrapheme)
+	want := []int{0, 1, 1, 2, 2, 3, 4}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("FromRuneOffsets = %v, want %v", got, want)
+		}
+	}
+}